@@ -0,0 +1,271 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var (
+	ErrDestinationNotAllowed = errors.New("destination not allowed")
+	ErrPortNotAllowed        = errors.New("port not allowed")
+)
+
+// AllowCIDRs returns a Config.AllowClient function accepting clients whose
+// address is in one of cidrs.
+func AllowCIDRs(cidrs ...string) (func(remote net.Addr) bool, error) {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	return func(remote net.Addr) bool {
+		return containsIP(nets, addrIP(remote))
+	}, nil
+}
+
+// DenyCIDRs returns a Config.AllowClient function rejecting clients whose
+// address is in one of cidrs.
+func DenyCIDRs(cidrs ...string) (func(remote net.Addr) bool, error) {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	return func(remote net.Addr) bool {
+		ip := addrIP(remote)
+		return ip != nil && !containsIP(nets, ip)
+	}, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// PortRange is a range of ports from From to To inclusive, see
+// Config.AllowedPorts.
+type PortRange struct {
+	From, To uint16
+}
+
+// Ports returns the ranges of the single ports.
+func Ports(ports ...uint16) []PortRange {
+	ranges := make([]PortRange, len(ports))
+	for i, port := range ports {
+		ranges[i] = PortRange{From: port, To: port}
+	}
+	return ranges
+}
+
+// WebPorts returns the ports of HTTP and HTTPS, for Config.AllowedPorts to
+// only let web traffic through.
+func WebPorts() []PortRange {
+	return Ports(80, 443)
+}
+
+// SMTPPorts returns the ports of mail submission and relay, for
+// Config.DeniedPorts to keep the server from relaying spam.
+func SMTPPorts() []PortRange {
+	return Ports(25, 465, 587)
+}
+
+func containsPort(ranges []PortRange, port uint16) bool {
+	for _, r := range ranges {
+		if r.From <= port && port <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// allowPort reports whether CONNECT requests and UDP datagrams may target
+// port according to config.AllowedPorts and config.DeniedPorts.
+func allowPort(config *Config, port uint16) bool {
+	if len(config.AllowedPorts) > 0 && !containsPort(config.AllowedPorts, port) {
+		return false
+	}
+	return !containsPort(config.DeniedPorts, port)
+}
+
+// checkSelfConnect returns ErrSelfConnect if the target of req is a listener
+// of the server of its connection, unless config.PreventSelfConnect is
+// false.
+func checkSelfConnect(config *Config, req *Request) error {
+	if config.PreventSelfConnect != nil && !*config.PreventSelfConnect {
+		return nil
+	}
+	server := serverFromContext(req.Context())
+	if server == nil {
+		return nil
+	}
+	for _, ip := range req.IPs {
+		if server.isOwnAddress(ip, int(req.Port)) {
+			return ErrSelfConnect
+		}
+	}
+	return nil
+}
+
+// allowDestination runs config.AllowDestination, then the AllowDestination
+// of the policy of the user, on req.
+func allowDestination(config *Config, req *Request) error {
+	if config.AllowDestination != nil {
+		if err := config.AllowDestination(req); err != nil {
+			return err
+		}
+	}
+	if policy := req.ConnInfo.Policy; policy != nil && policy.AllowDestination != nil {
+		return policy.AllowDestination(req)
+	}
+	return nil
+}
+
+// DestinationMatcher decides which targets clients may connect to from lists
+// of allow and deny rules. A rule is a hostname such as "example.com", a
+// wildcard such as "*.example.com" matching any subdomain, or an IP address
+// or CIDR range such as "10.0.0.0/8".
+//
+// Hostname rules apply to the domain of requests, address rules to the
+// addresses requests resolve to or name. Deny rules take precedence over
+// allow rules: a request is denied if its domain matches a deny rule or any
+// of its addresses does. Otherwise it is allowed if there are no allow
+// rules, if its domain matches an allow rule, or if all of its addresses do.
+type DestinationMatcher struct {
+	allow, deny destinationRules
+}
+
+// destinationRules are compiled rules of a DestinationMatcher.
+type destinationRules struct {
+	hosts     map[string]struct{}
+	wildcards []string // suffixes including the leading dot
+	nets      []*net.IPNet
+}
+
+// NewDestinationMatcher compiles allow and deny rules.
+func NewDestinationMatcher(allow, deny []string) (*DestinationMatcher, error) {
+	m := &DestinationMatcher{}
+	if err := m.allow.add(allow); err != nil {
+		return nil, err
+	}
+	if err := m.deny.add(deny); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (r *destinationRules) add(rules []string) error {
+	for _, rule := range rules {
+		if strings.Contains(rule, "/") {
+			_, ipNet, err := net.ParseCIDR(rule)
+			if err != nil {
+				return err
+			}
+			r.nets = append(r.nets, ipNet)
+			continue
+		}
+		if ip := net.ParseIP(rule); ip != nil {
+			bits := 8 * IPv6Length
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*IPv4Length
+			}
+			r.nets = append(r.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		host := normalizeHost(rule)
+		if strings.HasPrefix(host, "*.") {
+			r.wildcards = append(r.wildcards, host[1:])
+			continue
+		}
+		if r.hosts == nil {
+			r.hosts = make(map[string]struct{})
+		}
+		r.hosts[host] = struct{}{}
+	}
+	return nil
+}
+
+func (r *destinationRules) empty() bool {
+	return len(r.hosts) == 0 && len(r.wildcards) == 0 && len(r.nets) == 0
+}
+
+func (r *destinationRules) matchHost(host string) bool {
+	if _, ok := r.hosts[host]; ok {
+		return true
+	}
+	for _, suffix := range r.wildcards {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeHost lowercases host and strips its trailing dot.
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Allowed reports whether the target of req may be connected to.
+func (m *DestinationMatcher) Allowed(req *Request) bool {
+	var host string
+	if req.AddrType == TypeDomain {
+		host = normalizeHost(req.Address)
+	}
+	ips := req.IPs
+	if len(ips) == 0 && host == "" {
+		if ip := net.ParseIP(req.Address); ip != nil {
+			ips = []net.IP{ip}
+		}
+	}
+
+	if host != "" && m.deny.matchHost(host) {
+		return false
+	}
+	for _, ip := range ips {
+		if containsIP(m.deny.nets, ip) {
+			return false
+		}
+	}
+
+	if m.allow.empty() || host != "" && m.allow.matchHost(host) {
+		return true
+	}
+	if len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !containsIP(m.allow.nets, ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowDestination returns a Config.AllowDestination function rejecting the
+// requests m doesn't allow with ErrDestinationNotAllowed.
+func (m *DestinationMatcher) AllowDestination() func(req *Request) error {
+	return func(req *Request) error {
+		if !m.Allowed(req) {
+			return ErrDestinationNotAllowed
+		}
+		return nil
+	}
+}
@@ -0,0 +1,184 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeConn is a net.Conn from remote that records whether it was read.
+type fakeConn struct {
+	net.Conn
+	remote net.Addr
+	read   bool
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *fakeConn) Read(p []byte) (int, error) {
+	c.read = true
+	return 0, net.ErrClosed
+}
+
+func TestAllowClient(t *testing.T) {
+	allow, err := AllowCIDRs("127.0.0.0/8", "::1/128")
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	config := Config{AuthMethod: MethodNoAuth, AllowClient: allow}
+
+	t.Run("disallowed client is closed before the handshake", func(t *testing.T) {
+		conn := &fakeConn{remote: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 4000}}
+		if err := handleConnection(&session{conn: conn}, &config); err != ErrClientNotAllowed {
+			t.Fatalf("should get error %s but got %v", ErrClientNotAllowed, err)
+		}
+		if conn.read {
+			t.Fatalf("should not read from a disallowed client")
+		}
+	})
+
+	t.Run("allowed client proceeds to the handshake", func(t *testing.T) {
+		conn := &fakeConn{remote: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 4000}}
+		if err := handleConnection(&session{conn: conn}, &config); err == ErrClientNotAllowed {
+			t.Fatalf("should allow client %s", conn.remote)
+		}
+		if !conn.read {
+			t.Fatalf("should read from an allowed client")
+		}
+	})
+}
+
+func TestDenyCIDRs(t *testing.T) {
+	deny, err := DenyCIDRs("192.168.0.0/16")
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if deny(&net.TCPAddr{IP: net.ParseIP("192.168.1.1")}) {
+		t.Fatalf("should deny 192.168.1.1")
+	}
+	if !deny(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}) {
+		t.Fatalf("should allow 10.0.0.1")
+	}
+	if _, err := DenyCIDRs("not a cidr"); err == nil {
+		t.Fatalf("should get error for an invalid CIDR")
+	}
+}
+
+func TestDestinationMatcher(t *testing.T) {
+	matcher, err := NewDestinationMatcher(
+		[]string{"*.example.com", "golang.org", "10.0.0.0/8"},
+		[]string{"private.example.com", "10.0.0.1"},
+	)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	domain := func(host string, ips ...string) *Request {
+		req := &Request{ClientRequestMessage: ClientRequestMessage{AddrType: TypeDomain, Address: host}}
+		for _, ip := range ips {
+			req.IPs = append(req.IPs, net.ParseIP(ip))
+		}
+		return req
+	}
+	literal := func(ip string) *Request {
+		return &Request{
+			ClientRequestMessage: ClientRequestMessage{AddrType: TypeIPv4, Address: ip},
+			IPs:                  []net.IP{net.ParseIP(ip)},
+		}
+	}
+
+	tests := []struct {
+		Name    string
+		Request *Request
+		Allowed bool
+	}{
+		{"wildcard", domain("www.example.com", "93.184.216.34"), true},
+		{"wildcard excludes the domain itself", domain("example.com", "93.184.216.34"), false},
+		{"exact host", domain("GoLang.org.", "142.250.0.1"), true},
+		{"other host", domain("example.org", "93.184.216.34"), false},
+		{"CIDR", literal("10.1.2.3"), true},
+		{"outside CIDR", literal("192.168.1.1"), false},
+		{"domain resolving into CIDR", domain("intranet", "10.1.2.3"), true},
+		{"domain resolving partly outside CIDR", domain("intranet", "10.1.2.3", "192.168.1.1"), false},
+		{"denied host overrides wildcard", domain("private.example.com", "93.184.216.34"), false},
+		{"denied address overrides CIDR", literal("10.0.0.1"), false},
+		{"denied address overrides allowed host", domain("api.example.com", "10.0.0.1"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if got := matcher.Allowed(test.Request); got != test.Allowed {
+				t.Fatalf("should get allowed %v but got %v", test.Allowed, got)
+			}
+		})
+	}
+
+	if err := matcher.AllowDestination()(literal("192.168.1.1")); err != ErrDestinationNotAllowed {
+		t.Fatalf("should get error %s but got %v", ErrDestinationNotAllowed, err)
+	}
+	if _, err := NewDestinationMatcher([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Fatalf("should fail to compile an invalid CIDR")
+	}
+}
+
+func TestPorts(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Allowed []PortRange
+		Denied  []PortRange
+		Port    uint16
+		Allow   bool
+	}{
+		{"no rules", nil, nil, 25, true},
+		{"web only allows 443", WebPorts(), nil, 443, true},
+		{"web only refuses 22", WebPorts(), nil, 22, false},
+		{"SMTP blocked", nil, SMTPPorts(), 25, false},
+		{"SMTP blocked allows 80", nil, SMTPPorts(), 80, true},
+		{"range start", []PortRange{{8000, 8999}}, nil, 8000, true},
+		{"range end", []PortRange{{8000, 8999}}, nil, 8999, true},
+		{"below range", []PortRange{{8000, 8999}}, nil, 7999, false},
+		{"above range", []PortRange{{8000, 8999}}, nil, 9000, false},
+		{"denied within allowed", []PortRange{{1, 65535}}, []PortRange{{6000, 6063}}, 6063, false},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			config := Config{
+				AuthMethod:   MethodNoAuth,
+				AllowedPorts: test.Allowed,
+				DeniedPorts:  test.Denied,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					client, _ := net.Pipe()
+					return client, nil
+				},
+			}
+			if err := initConfig(&config); err != nil {
+				t.Fatalf("init config failure: %s", err)
+			}
+			var buf bytes.Buffer
+			WriteClientRequestMessage(&buf, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeIPv4, Address: "0.0.0.0", Port: test.Port})
+			_, target, err := request(context.Background(), &buf, &config, ConnInfo{})
+			if target != nil {
+				target.Close()
+			}
+			if !test.Allow {
+				if err != ErrPortNotAllowed {
+					t.Fatalf("should get error %s but got %v", ErrPortNotAllowed, err)
+				}
+				if reply, _ := ReadServerReplyMessage(&buf); reply == nil || reply.Reply != ReplyConnectionNotAllowed {
+					t.Fatalf("should get reply %d but got %v", ReplyConnectionNotAllowed, reply)
+				}
+			} else if err != nil {
+				t.Fatalf("should allow port %d but got %s", test.Port, err)
+			}
+		})
+	}
+
+	t.Run("invalid range", func(t *testing.T) {
+		err := initConfig(&Config{AuthMethod: MethodNoAuth, DeniedPorts: []PortRange{{90, 80}}})
+		if !errors.Is(err, ErrInvalidPortRange) {
+			t.Fatalf("should get error %s but got %v", ErrInvalidPortRange, err)
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package socks5
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var ErrAccessLogFormatNotSupported = errors.New("access log format not supported")
+
+// AccessLogFormat is the format of the lines written to Config.AccessLog.
+// Every line describes a finished connection with the same fields: the time
+// it started, the client IP, the username, the command, the target, the
+// reply code, the bytes sent up and down and the duration.
+type AccessLogFormat string
+
+const (
+	// AccessLogColumnar writes the fields separated by spaces, with "-" for
+	// missing ones and values holding control characters quoted, as web
+	// server access logs do:
+	//
+	//	2026-10-15T07:11:12Z 127.0.0.1 alice CONNECT example.com:443 0 517 4096 1.5s
+	AccessLogColumnar AccessLogFormat = "columnar"
+	// AccessLogJSON writes a JSON object per line.
+	AccessLogJSON AccessLogFormat = "json"
+	// AccessLogLogfmt writes key=value pairs.
+	AccessLogLogfmt AccessLogFormat = "logfmt"
+)
+
+// accessLog writes the lines of Config.AccessLog.
+type accessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format func(stats ConnStats) string
+}
+
+func newAccessLog(config *Config) (*accessLog, error) {
+	if config.AccessLog == nil {
+		return nil, nil
+	}
+	l := &accessLog{w: config.AccessLog}
+	switch config.AccessLogFormat {
+	case "", AccessLogColumnar:
+		l.format = formatColumnar
+	case AccessLogJSON:
+		l.format = formatJSON
+	case AccessLogLogfmt:
+		l.format = formatLogfmt
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrAccessLogFormatNotSupported, config.AccessLogFormat)
+	}
+	return l, nil
+}
+
+// log writes the line of a finished connection.
+func (l *accessLog) log(stats ConnStats) {
+	if l == nil {
+		return
+	}
+	line := l.format(stats)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := io.WriteString(l.w, line+"\n"); err != nil {
+		log.Printf("write access log failure: %s", err)
+	}
+}
+
+// commandName returns the name of a request command, "" for none.
+func commandName(cmd Command) string {
+	switch cmd {
+	case CmdConnect:
+		return "CONNECT"
+	case CmdBind:
+		return "BIND"
+	case CmdUDP:
+		return "UDP_ASSOCIATE"
+	case 0:
+		return ""
+	}
+	return strconv.Itoa(int(cmd))
+}
+
+// accessLogFields are the fields of a line, "" for missing ones.
+func accessLogFields(stats ConnStats) (start, client, reply string) {
+	start = stats.StartTime.UTC().Format(time.RFC3339)
+	if ip := addrIP(stats.RemoteAddr); ip != nil {
+		client = ip.String()
+	} else if stats.RemoteAddr != nil {
+		client = stats.RemoteAddr.String()
+	}
+	if stats.Replied {
+		reply = strconv.Itoa(int(stats.Reply))
+	}
+	return start, client, reply
+}
+
+// hasControl reports whether s holds control or non-printable characters,
+// which could break a line or forge another if written as they are.
+func hasControl(s string) bool {
+	for _, r := range s {
+		if r == utf8.RuneError || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatColumnar(stats ConnStats) string {
+	start, client, reply := accessLogFields(stats)
+	fields := []string{
+		start, client, stats.Username, commandName(stats.Command), stats.Target, reply,
+		strconv.FormatInt(stats.BytesUp, 10), strconv.FormatInt(stats.BytesDown, 10),
+		stats.Duration.String(),
+	}
+	for i, field := range fields {
+		if field == "" {
+			fields[i] = "-"
+		} else if field = strings.ReplaceAll(field, " ", "_"); hasControl(field) {
+			fields[i] = strconv.Quote(field)
+		} else {
+			fields[i] = field
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+type accessLogEntry struct {
+	Time      string  `json:"time"`
+	Client    string  `json:"client"`
+	Username  string  `json:"username,omitempty"`
+	Command   string  `json:"command,omitempty"`
+	Target    string  `json:"target,omitempty"`
+	Reply     *int    `json:"reply,omitempty"`
+	BytesUp   int64   `json:"bytes_up"`
+	BytesDown int64   `json:"bytes_down"`
+	Duration  float64 `json:"duration"` // seconds
+}
+
+func formatJSON(stats ConnStats) string {
+	start, client, _ := accessLogFields(stats)
+	entry := accessLogEntry{
+		Time:      start,
+		Client:    client,
+		Username:  stats.Username,
+		Command:   commandName(stats.Command),
+		Target:    stats.Target,
+		BytesUp:   stats.BytesUp,
+		BytesDown: stats.BytesDown,
+		Duration:  stats.Duration.Seconds(),
+	}
+	if stats.Replied {
+		reply := int(stats.Reply)
+		entry.Reply = &reply
+	}
+	line, _ := json.Marshal(entry)
+	return string(line)
+}
+
+func formatLogfmt(stats ConnStats) string {
+	start, client, reply := accessLogFields(stats)
+	pairs := []struct{ key, value string }{
+		{"time", start},
+		{"client", client},
+		{"username", stats.Username},
+		{"command", commandName(stats.Command)},
+		{"target", stats.Target},
+		{"reply", reply},
+		{"bytes_up", strconv.FormatInt(stats.BytesUp, 10)},
+		{"bytes_down", strconv.FormatInt(stats.BytesDown, 10)},
+		{"duration", stats.Duration.String()},
+	}
+	var b strings.Builder
+	for i, pair := range pairs {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(pair.key)
+		b.WriteByte('=')
+		if strings.ContainsAny(pair.value, " =\"") || hasControl(pair.value) {
+			b.WriteString(strconv.Quote(pair.value))
+		} else {
+			b.WriteString(pair.value)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,113 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormat(t *testing.T) {
+	stats := ConnStats{
+		ConnInfo: ConnInfo{
+			RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000},
+			Username:   "alice",
+			Target:     "example.com:443",
+			Command:    CmdConnect,
+			StartTime:  time.Date(2026, 10, 15, 7, 11, 12, 0, time.UTC),
+		},
+		BytesUp:   517,
+		BytesDown: 4096,
+		Duration:  1500 * time.Millisecond,
+		Replied:   true,
+		Reply:     ReplySuccess,
+	}
+	tests := []struct {
+		Format AccessLogFormat
+		Line   string
+	}{
+		{AccessLogColumnar, "2026-10-15T07:11:12Z 192.0.2.1 alice CONNECT example.com:443 0 517 4096 1.5s"},
+		{AccessLogJSON, `{"time":"2026-10-15T07:11:12Z","client":"192.0.2.1","username":"alice","command":"CONNECT","target":"example.com:443","reply":0,"bytes_up":517,"bytes_down":4096,"duration":1.5}`},
+		{AccessLogLogfmt, "time=2026-10-15T07:11:12Z client=192.0.2.1 username=alice command=CONNECT target=example.com:443 reply=0 bytes_up=517 bytes_down=4096 duration=1.5s"},
+	}
+	for _, test := range tests {
+		t.Run(string(test.Format), func(t *testing.T) {
+			var buf bytes.Buffer
+			l, err := newAccessLog(&Config{AccessLog: &buf, AccessLogFormat: test.Format})
+			if err != nil {
+				t.Fatalf("new access log failure: %s", err)
+			}
+			l.log(stats)
+			if line := buf.String(); line != test.Line+"\n" {
+				t.Fatalf("should get line %q but got %q", test.Line, line)
+			}
+		})
+	}
+
+	t.Run("missing fields", func(t *testing.T) {
+		var buf bytes.Buffer
+		l, _ := newAccessLog(&Config{AccessLog: &buf})
+		l.log(ConnStats{ConnInfo: ConnInfo{StartTime: stats.StartTime}})
+		if line, want := buf.String(), "2026-10-15T07:11:12Z - - - - - 0 0 0s\n"; line != want {
+			t.Fatalf("should get line %q but got %q", want, line)
+		}
+	})
+
+	t.Run("control characters", func(t *testing.T) {
+		forged := stats
+		forged.Username = "alice\n2026-10-15T07:11:12Z 192.0.2.2 bob"
+		tests := []struct {
+			Format AccessLogFormat
+			Line   string
+		}{
+			{AccessLogColumnar, `2026-10-15T07:11:12Z 192.0.2.1 "alice\n2026-10-15T07:11:12Z_192.0.2.2_bob" CONNECT example.com:443 0 517 4096 1.5s`},
+			{AccessLogJSON, `{"time":"2026-10-15T07:11:12Z","client":"192.0.2.1","username":"alice\n2026-10-15T07:11:12Z 192.0.2.2 bob","command":"CONNECT","target":"example.com:443","reply":0,"bytes_up":517,"bytes_down":4096,"duration":1.5}`},
+			{AccessLogLogfmt, `time=2026-10-15T07:11:12Z client=192.0.2.1 username="alice\n2026-10-15T07:11:12Z 192.0.2.2 bob" command=CONNECT target=example.com:443 reply=0 bytes_up=517 bytes_down=4096 duration=1.5s`},
+		}
+		for _, test := range tests {
+			var buf bytes.Buffer
+			l, _ := newAccessLog(&Config{AccessLog: &buf, AccessLogFormat: test.Format})
+			l.log(forged)
+			if line := buf.String(); line != test.Line+"\n" {
+				t.Fatalf("%s: should get line %q but got %q", test.Format, test.Line, line)
+			}
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		err := initConfig(&Config{AuthMethod: MethodNoAuth, AccessLog: &bytes.Buffer{}, AccessLogFormat: "xml"})
+		if !errors.Is(err, ErrAccessLogFormatNotSupported) {
+			t.Fatalf("should get error %s but got %v", ErrAccessLogFormatNotSupported, err)
+		}
+	})
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	closed := make(chan struct{}, 1)
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodNoAuth,
+		AccessLog:  &buf,
+		OnClose:    func(stats ConnStats) { closed <- struct{}{} },
+	})
+	target := startEchoServer(t)
+
+	conn := dialConnect(t, proxyAddr, target)
+	conn.Write([]byte("ping"))
+	conn.Read(make([]byte, 4))
+	conn.Close()
+	<-closed
+
+	fields := strings.Fields(buf.String())
+	if len(fields) != 9 {
+		t.Fatalf("should get 9 fields but got %q", buf.String())
+	}
+	if fields[1] != "127.0.0.1" || fields[3] != "CONNECT" || fields[4] != target || fields[5] != "0" {
+		t.Fatalf("should log a successful CONNECT to %s from 127.0.0.1 but got %q", target, buf.String())
+	}
+	if fields[6] != "4" || fields[7] != "4" {
+		t.Fatalf("should log 4 bytes up and down but got %q", buf.String())
+	}
+}
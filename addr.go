@@ -0,0 +1,71 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+var ErrLinkLocalZoneRequired = errors.New("link-local IPv6 target requires Config.EgressInterface")
+
+// addrIP returns the IP of addr, or nil if it has none.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// addrPort returns the port of addr, or 0 if it has none.
+func addrPort(addr net.Addr) int {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.Port
+	case *net.UDPAddr:
+		return addr.Port
+	case nil:
+		return 0
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// targetZone returns the zone to reach ip with: config.EgressInterface for
+// link-local IPv6 addresses, which are ambiguous without one, and none for
+// other addresses.
+func targetZone(ip net.IP, config *Config) (string, error) {
+	if ip.To4() != nil || !ip.IsLinkLocalUnicast() {
+		return "", nil
+	}
+	if config.EgressInterface == "" {
+		return "", ErrLinkLocalZoneRequired
+	}
+	return config.EgressInterface, nil
+}
+
+// targetAddress formats ip and port as a dialable address, with the zone of
+// ip if it needs one.
+func targetAddress(ip net.IP, port string, config *Config) (string, error) {
+	zone, err := targetZone(ip, config)
+	if err != nil {
+		return "", err
+	}
+	host := ip.String()
+	if zone != "" {
+		host += "%" + zone
+	}
+	return net.JoinHostPort(host, port), nil
+}
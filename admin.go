@@ -0,0 +1,125 @@
+package socks5
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminConn is the JSON representation of a ConnInfo in the admin API.
+type adminConn struct {
+	ID           string    `json:"id"`
+	RemoteAddr   string    `json:"remote_addr"`
+	LocalAddr    string    `json:"local_addr"`
+	Username     string    `json:"username,omitempty"`
+	Target       string    `json:"target,omitempty"`
+	ServerName   string    `json:"server_name,omitempty"`
+	HostnameHint string    `json:"hostname_hint,omitempty"`
+	StartTime    time.Time `json:"start_time"`
+}
+
+// AdminHandler returns the handler of the admin HTTP API, which Run serves
+// on Config.AdminAddr:
+//
+//	GET    /connections       lists the active connections
+//	DELETE /connections/{id}  closes a connection
+//	GET    /stats             returns the ServerStats
+//	GET    /capabilities      returns the Capabilities
+//	POST   /drain?timeout=10s stops accepting connections and waits up to
+//	                          timeout, or as long as the request lasts
+//	                          without one, for the active ones to finish
+func (s *SOCKS5Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", s.adminConnections)
+	mux.HandleFunc("/connections/", s.adminCloseConnection)
+	mux.HandleFunc("/stats", s.adminStats)
+	mux.HandleFunc("/capabilities", s.adminCapabilities)
+	mux.HandleFunc("/drain", s.adminDrain)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		adminToken := s.config().AdminToken
+		if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *SOCKS5Server) adminConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	conns := []adminConn{}
+	for _, info := range s.ActiveConnections() {
+		conns = append(conns, adminConn{
+			ID:           info.ID,
+			RemoteAddr:   info.RemoteAddr.String(),
+			LocalAddr:    info.LocalAddr.String(),
+			Username:     info.Username,
+			Target:       info.Target,
+			ServerName:   info.ServerName,
+			HostnameHint: info.HostnameHint,
+			StartTime:    info.StartTime,
+		})
+	}
+	writeJSON(w, conns)
+}
+
+func (s *SOCKS5Server) adminCloseConnection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.Close(strings.TrimPrefix(r.URL.Path, "/connections/")); err == ErrConnectionNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *SOCKS5Server) adminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.Stats())
+}
+
+func (s *SOCKS5Server) adminCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.Capabilities())
+}
+
+func (s *SOCKS5Server) adminDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Without a timeout, wait for as long as the caller does
+	ctx := r.Context()
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	remaining, _ := s.DrainContext(ctx)
+	writeJSON(w, map[string]int{"remaining": remaining})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,172 @@
+package socks5
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAdminAPI(t *testing.T) {
+	server, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth, AdminToken: "secret"})
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+
+	call := func(method, path, token string, v interface{}) int {
+		t.Helper()
+		req, err := http.NewRequest(method, admin.URL+path, nil)
+		if err != nil {
+			t.Fatalf("new request failure: %s", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failure: %s", method, path, err)
+		}
+		defer resp.Body.Close()
+		if v != nil && resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("decode %s failure: %s", path, err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	target := startEchoServer(t)
+	conn := dialConnect(t, proxyAddr, target)
+	conn.Write([]byte("ping"))
+	io.ReadFull(conn, make([]byte, 4))
+
+	t.Run("unauthorized", func(t *testing.T) {
+		for _, token := range []string{"", "wrong"} {
+			if status := call(http.MethodGet, "/stats", token, nil); status != http.StatusUnauthorized {
+				t.Fatalf("should get status %d but got %d", http.StatusUnauthorized, status)
+			}
+		}
+	})
+
+	t.Run("connections", func(t *testing.T) {
+		var conns []adminConn
+		if status := call(http.MethodGet, "/connections", "secret", &conns); status != http.StatusOK {
+			t.Fatalf("should get status %d but got %d", http.StatusOK, status)
+		}
+		if len(conns) != 1 || conns[0].Target != target || conns[0].RemoteAddr != conn.LocalAddr().String() {
+			t.Fatalf("should get the connection to %s but got %v", target, conns)
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		var stats ServerStats
+		if status := call(http.MethodGet, "/stats", "secret", &stats); status != http.StatusOK {
+			t.Fatalf("should get status %d but got %d", http.StatusOK, status)
+		}
+		want := ServerStats{ActiveConnections: 1, TotalConnections: 1, BytesUp: 4, BytesDown: 4}
+		if stats != want {
+			t.Fatalf("should get stats %+v but got %+v", want, stats)
+		}
+	})
+
+	t.Run("capabilities", func(t *testing.T) {
+		var caps []string
+		if status := call(http.MethodGet, "/capabilities", "secret", &caps); status != http.StatusOK {
+			t.Fatalf("should get status %d but got %d", http.StatusOK, status)
+		}
+		if want := server.Capabilities(); !reflect.DeepEqual(caps, want) {
+			t.Fatalf("should get capabilities %v but got %v", want, caps)
+		}
+	})
+
+	t.Run("close connection", func(t *testing.T) {
+		if status := call(http.MethodDelete, "/connections/1", "secret", nil); status != http.StatusNoContent {
+			t.Fatalf("should get status %d but got %d", http.StatusNoContent, status)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("should get error EOF but got %v", err)
+		}
+		if status := call(http.MethodDelete, "/connections/404", "secret", nil); status != http.StatusNotFound {
+			t.Fatalf("should get status %d but got %d", http.StatusNotFound, status)
+		}
+	})
+
+	t.Run("drain", func(t *testing.T) {
+		var result struct{ Remaining int }
+		if status := call(http.MethodPost, "/drain?timeout=1s", "secret", &result); status != http.StatusOK {
+			t.Fatalf("should get status %d but got %d", http.StatusOK, status)
+		}
+		if result.Remaining != 0 {
+			t.Fatalf("should get no remaining connection but got %d", result.Remaining)
+		}
+		if status := call(http.MethodPost, "/drain?timeout=soon", "secret", nil); status != http.StatusBadRequest {
+			t.Fatalf("should get status %d but got %d", http.StatusBadRequest, status)
+		}
+	})
+}
+
+func TestAdminDrainWithoutTimeout(t *testing.T) {
+	proxyAddrs, adminAddrs := make(chan string, 1), make(chan string, 1)
+	config := &Config{AuthMethod: MethodNoAuth, AdminAddr: "127.0.0.1:0", AdminToken: "secret"}
+	config.Listen = func(network, address string) (net.Listener, error) {
+		listener, err := net.Listen(network, "127.0.0.1:0")
+		if err == nil && address == config.AdminAddr {
+			adminAddrs <- listener.Addr().String()
+		} else if err == nil {
+			proxyAddrs <- listener.Addr().String()
+		}
+		return listener, err
+	}
+	server := &SOCKS5Server{Config: config}
+	runErr := make(chan error, 1)
+	go func() { runErr <- server.Run() }()
+	conn := dialConnect(t, <-proxyAddrs, startEchoServer(t))
+
+	drained := make(chan int, 1)
+	adminAddr := <-adminAddrs
+	go func() {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+adminAddr+"/drain", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			drained <- -1
+			return
+		}
+		defer resp.Body.Close()
+		var result struct{ Remaining int }
+		json.NewDecoder(resp.Body).Decode(&result)
+		drained <- result.Remaining
+	}()
+
+	// Run keeps going, admin API included, while the connection is open
+	select {
+	case err := <-runErr:
+		t.Fatalf("should wait for the active connection but got %v", err)
+	case remaining := <-drained:
+		t.Fatalf("should wait for the active connection but got %d remaining", remaining)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	conn.Close()
+	if remaining := <-drained; remaining != 0 {
+		t.Fatalf("should wait for the connection to close but got %d remaining", remaining)
+	}
+	select {
+	case err := <-runErr:
+		if err != ErrServerClosed {
+			t.Fatalf("should get error %s but got %v", ErrServerClosed, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("should return once the connection is done")
+	}
+}
+
+func TestAdminTokenRequired(t *testing.T) {
+	if err := initConfig(&Config{AdminAddr: "127.0.0.1:0"}); err != ErrAdminTokenNotSet {
+		t.Fatalf("should get error %s but got %v", ErrAdminTokenNotSet, err)
+	}
+}
@@ -3,6 +3,9 @@ package socks5
 import (
 	"errors"
 	"io"
+	"log"
+	"runtime/debug"
+	"time"
 )
 
 type ClientAuthMessage struct {
@@ -33,9 +36,147 @@ const (
 
 var (
 	ErrPasswordCheckerNotSet = errors.New("error password checker not set")
-	ErrPasswordAuthFailure   = errors.New("error authenticating username/password")
+	ErrPasswordAuthFailure   = newHandshakeError(StagePassword, "error authenticating username/password")
+	ErrPasswordCheckerPanic  = newHandshakeError(StagePassword, "password checker panicked")
+	ErrUserConnectionLimit   = errors.New("user connection limit reached")
+	ErrNoAuthConnectionLimit = errors.New("no-auth connection limit reached")
 )
 
+// Authenticator checks username/password credentials. It returns false with a
+// nil error to reject the credentials, and a non-nil error when it was unable
+// to check them (e.g. its backing store is unreachable).
+type Authenticator interface {
+	Authenticate(username, password string) (bool, error)
+}
+
+// AuthFailMode is what the server does with credentials when one of the
+// checkers of Config is unavailable.
+type AuthFailMode int
+
+const (
+	// AuthFailOpen tries the next checkers, e.g. a local store backing up
+	// an LDAP server, and only rejects the credentials if none accepts them.
+	AuthFailOpen AuthFailMode = iota
+	// AuthFailClosed rejects the credentials right away.
+	AuthFailClosed
+)
+
+// AuthenticatorFunc adapts an ordinary function to an Authenticator.
+type AuthenticatorFunc func(username, password string) (bool, error)
+
+func (f AuthenticatorFunc) Authenticate(username, password string) (bool, error) {
+	return f(username, password)
+}
+
+// AuthResult is the outcome of a successful username/password
+// authentication.
+type AuthResult struct {
+	// Username identifies the connection from then on. It may differ from
+	// the username sent by the client, e.g. to name an account.
+	Username string
+	// Policy, if set, restricts the connection.
+	Policy *UserPolicy
+	// Method is the auth method selected, set by the server.
+	Method Method
+
+	// dialTimeout is the dial timeout the client asked for with
+	// MethodDialTimeout
+	dialTimeout time.Duration
+}
+
+// UserPolicy restricts the connections of a user on top of Config.
+type UserPolicy struct {
+	// AllowDestination, if set, is called for every request after
+	// Config.AllowDestination, with the same semantics.
+	AllowDestination func(req *Request) error
+	// MaxBytesPerConn, if positive, replaces Config.MaxBytesPerConn.
+	MaxBytesPerConn int64
+	// MaxConnections, if positive, limits the simultaneous connections of
+	// the user. Connections over it are closed after authentication.
+	MaxConnections int
+}
+
+// boolChecker adapts a Config.PasswordChecker to the signature of
+// Config.AuthChecker.
+func boolChecker(check func(username, password string) bool) func(username, password string) (*AuthResult, error) {
+	return func(username, password string) (*AuthResult, error) {
+		if !check(username, password) {
+			return nil, nil
+		}
+		return &AuthResult{Username: username}, nil
+	}
+}
+
+// checkPassword tries config.AuthChecker, config.PasswordChecker and then
+// config.Authenticators in order, succeeding on the first that accepts the
+// credentials. If all of them reject, the last error reported by a checker or
+// an authenticator is returned, otherwise ErrPasswordAuthFailure. With
+// AuthFailClosed, the first error is returned right away. A checker
+// that panics fails with ErrPasswordCheckerPanic. The errors of checkers and
+// authenticators are wrapped to report StagePassword.
+func checkPassword(config *Config, username, password string) (*AuthResult, error) {
+	var checkers []func(username, password string) (*AuthResult, error)
+	if config.AuthChecker != nil {
+		checkers = append(checkers, config.AuthChecker)
+	}
+	if config.PasswordChecker != nil {
+		checkers = append(checkers, boolChecker(config.PasswordChecker))
+	}
+	for _, authenticator := range config.Authenticators {
+		authenticator := authenticator
+		checkers = append(checkers, func(username, password string) (*AuthResult, error) {
+			ok, err := authenticator.Authenticate(username, password)
+			if !ok || err != nil {
+				return nil, err
+			}
+			return &AuthResult{Username: username}, nil
+		})
+	}
+
+	var lastErr error
+	for _, check := range checkers {
+		result, err := safeCheck(check, username, password)
+		if err != nil {
+			log.Printf("authenticator failure for %s: %s", username, err)
+			var handshakeErr HandshakeError
+			if !errors.As(err, &handshakeErr) {
+				err = &stageError{stage: StagePassword, err: err}
+			}
+			if config.AuthFailMode == AuthFailClosed {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		if result != nil {
+			return result, nil
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, ErrPasswordAuthFailure
+}
+
+// maxPanicStack is the length of the stack logged when a checker panics.
+const maxPanicStack = 2048
+
+// safeCheck calls check, turning a panic into ErrPasswordCheckerPanic so that
+// a broken checker fails the handshake instead of crashing the server.
+func safeCheck(check func(username, password string) (*AuthResult, error), username, password string) (result *AuthResult, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			if len(stack) > maxPanicStack {
+				stack = stack[:maxPanicStack]
+			}
+			log.Printf("password checker panic for %s: %v\n%s", username, r, stack)
+			result, err = nil, ErrPasswordCheckerPanic
+		}
+	}()
+	return check(username, password)
+}
+
 func NewClientAuthMessage(conn io.Reader) (*ClientAuthMessage, error) {
 	// Read version, nMethods
 	buf := make([]byte, 2)
@@ -70,6 +211,25 @@ func NewServerAuthMessage(conn io.Writer, method Method) error {
 	return err
 }
 
+// WriteClientAuthMessage writes the methods offered by a client.
+func WriteClientAuthMessage(conn io.Writer, message *ClientAuthMessage) error {
+	buf := append([]byte{SOCKS5Version, byte(len(message.Methods))}, message.Methods...)
+	_, err := conn.Write(buf)
+	return err
+}
+
+// ReadServerAuthMessage reads the method selected by the server.
+func ReadServerAuthMessage(conn io.Reader) (Method, error) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return 0, err
+	}
+	if buf[0] != SOCKS5Version {
+		return 0, ErrVersionNotSupported
+	}
+	return buf[1], nil
+}
+
 func NewClientPasswordMessage(conn io.Reader) (*ClientPasswordMessage, error) {
 	// Read version and username length
 	buf := make([]byte, 2)
@@ -82,7 +242,7 @@ func NewClientPasswordMessage(conn io.Reader) (*ClientPasswordMessage, error) {
 	}
 
 	// Read username, password length
-	buf = make([]byte, usernameLen+1)
+	buf = make([]byte, int(usernameLen)+1)
 	if _, err := io.ReadFull(conn, buf); err != nil {
 		return nil, err
 	}
@@ -102,6 +262,31 @@ func NewClientPasswordMessage(conn io.Reader) (*ClientPasswordMessage, error) {
 	}, nil
 }
 
+// WriteClientPasswordMessage writes the credentials sent by a client.
+func WriteClientPasswordMessage(conn io.Writer, message *ClientPasswordMessage) error {
+	if len(message.Username) > 255 || len(message.Password) > 255 {
+		return errors.New("username or password too long")
+	}
+	buf := []byte{PasswordMethodVersion, byte(len(message.Username))}
+	buf = append(buf, message.Username...)
+	buf = append(buf, byte(len(message.Password)))
+	buf = append(buf, message.Password...)
+	_, err := conn.Write(buf)
+	return err
+}
+
+// ReadServerPasswordMessage reads the status of a password authentication.
+func ReadServerPasswordMessage(conn io.Reader) (byte, error) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return 0, err
+	}
+	if buf[0] != PasswordMethodVersion {
+		return 0, ErrMethodVersionNotSupported
+	}
+	return buf[1], nil
+}
+
 func WriteServerPasswordMessage(conn io.Writer, status byte) error {
 	_, err := conn.Write([]byte{PasswordMethodVersion, status})
 	return err
@@ -2,9 +2,16 @@ package socks5
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"log"
+	"net"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestNewClientAuthMesssage(t *testing.T) {
@@ -87,3 +94,409 @@ func TestNewClientPasswordMessage(t *testing.T) {
 		}
 	})
 }
+
+func TestAuthMessagesOneByteAtATime(t *testing.T) {
+	t.Run("auth message", func(t *testing.T) {
+		r := iotest.OneByteReader(bytes.NewReader([]byte{SOCKS5Version, 2, MethodNoAuth, MethodPassword}))
+		message, err := NewClientAuthMessage(r)
+		if err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+		if !reflect.DeepEqual(message.Methods, []Method{MethodNoAuth, MethodPassword}) {
+			t.Fatalf("should get methods %v but got %v", []Method{MethodNoAuth, MethodPassword}, message.Methods)
+		}
+	})
+
+	t.Run("password message", func(t *testing.T) {
+		var buf bytes.Buffer
+		WriteClientPasswordMessage(&buf, &ClientPasswordMessage{Username: "admin", Password: "123456"})
+		message, err := NewClientPasswordMessage(iotest.OneByteReader(&buf))
+		if err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+		if want := (ClientPasswordMessage{Username: "admin", Password: "123456"}); *message != want {
+			t.Fatalf("should get message %v but got %v", want, *message)
+		}
+	})
+}
+
+func TestPasswordLengthEdgeCases(t *testing.T) {
+	long := strings.Repeat("x", 255)
+	tests := []struct {
+		Name     string
+		Username string
+		Password string
+	}{
+		{"empty username", "", "123456"},
+		{"empty password", "admin", ""},
+		{"empty username and password", "", ""},
+		{"max length", long, long},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			buf.Write([]byte{SOCKS5Version, 1, MethodPassword})
+			WriteClientPasswordMessage(&buf, &ClientPasswordMessage{Username: test.Username, Password: test.Password})
+
+			var gotUsername, gotPassword string
+			config := Config{AuthMethod: MethodPassword, PasswordChecker: func(username, password string) bool {
+				gotUsername, gotPassword = username, password
+				return true
+			}}
+			if _, _, err := auth(&buf, &config, nil); err != nil {
+				t.Fatalf("should get error nil but got %s", err)
+			}
+			if gotUsername != test.Username || gotPassword != test.Password {
+				t.Fatalf("should check %q/%q but got %q/%q", test.Username, test.Password, gotUsername, gotPassword)
+			}
+		})
+	}
+}
+
+func TestAuthenticatorChain(t *testing.T) {
+	errUnavailable := errors.New("ldap unavailable")
+	unavailable := AuthenticatorFunc(func(username, password string) (bool, error) {
+		return false, errUnavailable
+	})
+	local := AuthenticatorFunc(func(username, password string) (bool, error) {
+		return username == "admin" && password == "123456", nil
+	})
+
+	authenticate := func(config *Config, username, password string) error {
+		var buf bytes.Buffer
+		buf.Write([]byte{SOCKS5Version, 1, MethodPassword})
+		buf.Write([]byte{PasswordMethodVersion, byte(len(username))})
+		buf.WriteString(username)
+		buf.WriteByte(byte(len(password)))
+		buf.WriteString(password)
+		_, _, err := auth(&buf, config, nil)
+		return err
+	}
+
+	t.Run("failing first authenticator falls through to second", func(t *testing.T) {
+		config := Config{AuthMethod: MethodPassword, Authenticators: []Authenticator{unavailable, local}}
+		if err := authenticate(&config, "admin", "123456"); err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+	})
+
+	t.Run("all authenticators reject", func(t *testing.T) {
+		config := Config{AuthMethod: MethodPassword, Authenticators: []Authenticator{local}}
+		if err := authenticate(&config, "admin", "wrong"); err != ErrPasswordAuthFailure {
+			t.Fatalf("should get error %s but got %v", ErrPasswordAuthFailure, err)
+		}
+	})
+
+	t.Run("authenticator error is reported", func(t *testing.T) {
+		config := Config{AuthMethod: MethodPassword, Authenticators: []Authenticator{unavailable, local}}
+		if err := authenticate(&config, "admin", "wrong"); !errors.Is(err, errUnavailable) {
+			t.Fatalf("should get error %s but got %v", errUnavailable, err)
+		}
+	})
+}
+
+func TestAuthFailMode(t *testing.T) {
+	errUnavailable := errors.New("ldap unavailable")
+	ldap := AuthenticatorFunc(func(username, password string) (bool, error) {
+		return false, errUnavailable
+	})
+	var localCalls int
+	local := AuthenticatorFunc(func(username, password string) (bool, error) {
+		localCalls++
+		return username == "admin" && password == "123456", nil
+	})
+
+	authenticate := func(mode AuthFailMode) error {
+		var buf bytes.Buffer
+		buf.Write([]byte{SOCKS5Version, 1, MethodPassword})
+		WriteClientPasswordMessage(&buf, &ClientPasswordMessage{Username: "admin", Password: "123456"})
+		config := Config{AuthMethod: MethodPassword, Authenticators: []Authenticator{ldap, local}, AuthFailMode: mode}
+		_, _, err := auth(&buf, &config, nil)
+		return err
+	}
+
+	t.Run("fail open", func(t *testing.T) {
+		localCalls = 0
+		if err := authenticate(AuthFailOpen); err != nil {
+			t.Fatalf("should fall back to the local store but got %s", err)
+		}
+		if localCalls != 1 {
+			t.Fatalf("should check the local store once but got %d", localCalls)
+		}
+	})
+
+	t.Run("fail closed", func(t *testing.T) {
+		localCalls = 0
+		if err := authenticate(AuthFailClosed); !errors.Is(err, errUnavailable) {
+			t.Fatalf("should get error %s but got %v", errUnavailable, err)
+		}
+		if localCalls != 0 {
+			t.Fatalf("should not check the local store but got %d calls", localCalls)
+		}
+	})
+}
+
+func TestOnUnacceptableAuth(t *testing.T) {
+	type call struct {
+		remote  net.Addr
+		offered []Method
+	}
+	calls := make(chan call, 1)
+	config := &Config{
+		AuthMethod:      MethodPassword,
+		PasswordChecker: func(username, password string) bool { return true },
+		OnUnacceptableAuth: func(remote net.Addr, offered []Method) {
+			calls <- call{remote, offered}
+		},
+	}
+	_, addr := startServer(t, config)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial failure: %s", err)
+	}
+	defer conn.Close()
+	if err := WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodNoAuth}}); err != nil {
+		t.Fatalf("write failure: %s", err)
+	}
+	method, err := ReadServerAuthMessage(conn)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if method != MethodNoAcceptable {
+		t.Fatalf("should get method %d but got %d", MethodNoAcceptable, method)
+	}
+
+	got := <-calls
+	if got.remote.String() != conn.LocalAddr().String() {
+		t.Fatalf("should get remote %s but got %s", conn.LocalAddr(), got.remote)
+	}
+	if want := []Method{MethodNoAuth}; !reflect.DeepEqual(want, got.offered) {
+		t.Fatalf("should get offered methods %v but got %v", want, got.offered)
+	}
+}
+
+func TestAuthMessageRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteClientAuthMessage(&buf, &ClientAuthMessage{Methods: []Method{MethodNoAuth, MethodPassword}}); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	message, err := NewClientAuthMessage(&buf)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if !reflect.DeepEqual(message.Methods, []Method{MethodNoAuth, MethodPassword}) {
+		t.Fatalf("should get methods %v but got %v", []Method{MethodNoAuth, MethodPassword}, message.Methods)
+	}
+
+	if err := NewServerAuthMessage(&buf, MethodPassword); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if method, err := ReadServerAuthMessage(&buf); err != nil || method != MethodPassword {
+		t.Fatalf("should get method %d but got %d, %v", MethodPassword, method, err)
+	}
+}
+
+func TestPasswordMessageRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	want := ClientPasswordMessage{Username: "admin", Password: "123456"}
+	if err := WriteClientPasswordMessage(&buf, &want); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	message, err := NewClientPasswordMessage(&buf)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if *message != want {
+		t.Fatalf("should get message %#v but got %#v", want, *message)
+	}
+
+	if err := WriteServerPasswordMessage(&buf, PasswordAuthFailure); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if status, err := ReadServerPasswordMessage(&buf); err != nil || status != PasswordAuthFailure {
+		t.Fatalf("should get status %d but got %d, %v", PasswordAuthFailure, status, err)
+	}
+}
+
+func TestUserPolicy(t *testing.T) {
+	allowed, denied := startEchoServer(t), startEchoServer(t)
+	closed := make(chan ConnStats, 2)
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodPassword,
+		AuthChecker: func(username, password string) (*AuthResult, error) {
+			if password != "secret" {
+				return nil, nil
+			}
+			policy := &UserPolicy{AllowDestination: func(req *Request) error {
+				if net.JoinHostPort(req.Address, strconv.Itoa(int(req.Port))) != allowed {
+					return &RejectError{Reply: ReplyConnectionNotAllowed, Reason: "not in the plan of " + username}
+				}
+				return nil
+			}}
+			return &AuthResult{Username: "tenant-" + username, Policy: policy}, nil
+		},
+		OnClose: func(stats ConnStats) { closed <- stats },
+	})
+
+	connect := func(target string) byte {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("dial proxy failure: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		host, port, _ := net.SplitHostPort(target)
+		portNum, _ := strconv.Atoi(port)
+		WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodPassword}})
+		WriteClientPasswordMessage(conn, &ClientPasswordMessage{Username: "alice", Password: "secret"})
+		WriteClientRequestMessage(conn, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeIPv4, Address: host, Port: uint16(portNum)})
+		if _, err := ReadServerAuthMessage(conn); err != nil {
+			t.Fatalf("read auth reply failure: %s", err)
+		}
+		if status, err := ReadServerPasswordMessage(conn); err != nil || status != PasswordAuthSuccess {
+			t.Fatalf("should get status %d but got %d, %v", PasswordAuthSuccess, status, err)
+		}
+		reply, err := ReadServerReplyMessage(conn)
+		if err != nil {
+			t.Fatalf("read request reply failure: %s", err)
+		}
+		return reply.Reply
+	}
+
+	if reply := connect(allowed); reply != ReplySuccess {
+		t.Fatalf("should get reply %d but got %d", ReplySuccess, reply)
+	}
+	if stats := <-closed; stats.Username != "tenant-alice" {
+		t.Fatalf("should get username tenant-alice but got %q", stats.Username)
+	}
+	if reply := connect(denied); reply != ReplyConnectionNotAllowed {
+		t.Fatalf("should get reply %d but got %d", ReplyConnectionNotAllowed, reply)
+	}
+}
+
+func TestMaxNoAuthConns(t *testing.T) {
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethods:     []Method{MethodPassword, MethodNoAuth},
+		PasswordChecker: func(username, password string) bool { return password == "secret" },
+		MaxNoAuthConns:  1,
+	})
+	target := startEchoServer(t)
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+
+	// connect sends a CONNECT request with the given auth method and
+	// returns its reply.
+	connect := func(method Method) ReplyType {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("dial proxy failure: %s", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{method}})
+		if selected, err := ReadServerAuthMessage(conn); err != nil || selected != method {
+			t.Fatalf("should select method %d but got %d, %v", method, selected, err)
+		}
+		if method == MethodPassword {
+			WriteClientPasswordMessage(conn, &ClientPasswordMessage{Username: "admin", Password: "secret"})
+			if status, err := ReadServerPasswordMessage(conn); err != nil || status != PasswordAuthSuccess {
+				t.Fatalf("should get status %d but got %d, %v", PasswordAuthSuccess, status, err)
+			}
+		}
+		WriteClientRequestMessage(conn, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeIPv4, Address: host, Port: uint16(portNum)})
+		reply, err := ReadServerReplyMessage(conn)
+		if err != nil {
+			t.Fatalf("read request reply failure: %s", err)
+		}
+		return reply.Reply
+	}
+
+	if reply := connect(MethodNoAuth); reply != ReplySuccess {
+		t.Fatalf("should get a no-auth slot but got reply %d", reply)
+	}
+	if reply := connect(MethodNoAuth); reply != ReplyServerFailure {
+		t.Fatalf("should get reply %d over the no-auth limit but got %d", ReplyServerFailure, reply)
+	}
+	if reply := connect(MethodPassword); reply != ReplySuccess {
+		t.Fatalf("should get a slot for an authenticated connection but got reply %d", reply)
+	}
+}
+
+func TestUserConnectionLimitReply(t *testing.T) {
+	const customReply ReplyType = 0x42
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodPassword,
+		AuthChecker: func(username, password string) (*AuthResult, error) {
+			return &AuthResult{Username: username, Policy: &UserPolicy{MaxConnections: 1}}, nil
+		},
+		LimitReply: customReply,
+	})
+	target := startEchoServer(t)
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+
+	connect := func() (net.Conn, ReplyType) {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("dial proxy failure: %s", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodPassword}})
+		WriteClientPasswordMessage(conn, &ClientPasswordMessage{Username: "alice", Password: "secret"})
+		WriteClientRequestMessage(conn, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeIPv4, Address: host, Port: uint16(portNum)})
+		ReadServerAuthMessage(conn)
+		ReadServerPasswordMessage(conn)
+		reply, err := ReadServerReplyMessage(conn)
+		if err != nil {
+			t.Fatalf("should get a reply before the close but got %s", err)
+		}
+		return conn, reply.Reply
+	}
+
+	if _, reply := connect(); reply != ReplySuccess {
+		t.Fatalf("should get reply %d but got %d", ReplySuccess, reply)
+	}
+	conn, reply := connect()
+	if reply != customReply {
+		t.Fatalf("should get reply %d over the user limit but got %d", customReply, reply)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("should get EOF after the reply but got %v", err)
+	}
+}
+
+func TestPasswordCheckerPanic(t *testing.T) {
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodPassword,
+		PasswordChecker: func(username, password string) bool {
+			if username == "mallory" {
+				panic("checker bug")
+			}
+			return username == "alice" && password == "secret"
+		},
+	})
+
+	authenticate := func(username string) (byte, error) {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("dial proxy failure: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodPassword}})
+		WriteClientPasswordMessage(conn, &ClientPasswordMessage{Username: username, Password: "secret"})
+		if _, err := ReadServerAuthMessage(conn); err != nil {
+			return 0, err
+		}
+		return ReadServerPasswordMessage(conn)
+	}
+
+	if status, err := authenticate("mallory"); err != nil || status != PasswordAuthFailure {
+		t.Fatalf("should get status %d for a panicking checker but got %d, %v", PasswordAuthFailure, status, err)
+	}
+	if status, err := authenticate("alice"); err != nil || status != PasswordAuthSuccess {
+		t.Fatalf("should keep serving after the panic but got %d, %v", status, err)
+	}
+}
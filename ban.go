@@ -0,0 +1,98 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrClientBanned = errors.New("client banned after repeated auth failures")
+
+// maxBanEntries is the number of tracked IPs above which expired entries
+// are pruned.
+const maxBanEntries = 1024
+
+// authBans tracks the password failures of client IPs and bans those that
+// fail too often.
+type authBans struct {
+	mu          sync.Mutex
+	maxFailures int
+	duration    time.Duration
+	entries     map[string]*authFailures
+}
+
+type authFailures struct {
+	count       int
+	expires     time.Time // of the failure count
+	bannedUntil time.Time
+}
+
+func newAuthBans(config *Config) *authBans {
+	if config.MaxAuthFailures <= 0 || config.AuthBanDuration <= 0 {
+		return nil
+	}
+	return &authBans{
+		maxFailures: config.MaxAuthFailures,
+		duration:    config.AuthBanDuration,
+		entries:     make(map[string]*authFailures),
+	}
+}
+
+// ipKey normalizes ip so that an IPv4 address and its IPv4-mapped IPv6 form
+// are tracked together.
+func ipKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.String()
+}
+
+func (b *authBans) banned(ip net.IP) bool {
+	if b == nil || ip == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.entries[ipKey(ip)]
+	return ok && time.Now().Before(entry.bannedUntil)
+}
+
+// fail records a failure of ip, banning it once it has failed maxFailures
+// times within the ban duration.
+func (b *authBans) fail(ip net.IP) {
+	if b == nil || ip == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if len(b.entries) >= maxBanEntries {
+		for key, entry := range b.entries {
+			if now.After(entry.expires) && now.After(entry.bannedUntil) {
+				delete(b.entries, key)
+			}
+		}
+	}
+
+	key := ipKey(ip)
+	entry, ok := b.entries[key]
+	if !ok || now.After(entry.expires) {
+		entry = &authFailures{expires: now.Add(b.duration)}
+		b.entries[key] = entry
+	}
+	if entry.count++; entry.count >= b.maxFailures {
+		entry.bannedUntil = now.Add(b.duration)
+		entry.count = 0
+	}
+}
+
+// succeed forgets the failures of ip.
+func (b *authBans) succeed(ip net.IP) {
+	if b == nil || ip == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.entries, ipKey(ip))
+}
@@ -0,0 +1,53 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuthBans(t *testing.T) {
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod:      MethodPassword,
+		PasswordChecker: func(username, password string) bool { return password == "secret" },
+		MaxAuthFailures: 2,
+		AuthBanDuration: 200 * time.Millisecond,
+	})
+
+	// login returns the status of a password authentication, or an error
+	// if the server closed the connection.
+	login := func(password string) (byte, error) {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("dial proxy failure: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodPassword}})
+		if _, err := ReadServerAuthMessage(conn); err != nil {
+			return 0, err
+		}
+		WriteClientPasswordMessage(conn, &ClientPasswordMessage{Username: "admin", Password: password})
+		return ReadServerPasswordMessage(conn)
+	}
+
+	for i := 0; i < 2; i++ {
+		if status, err := login("wrong"); err != nil || status != PasswordAuthFailure {
+			t.Fatalf("should get status %d but got %d, %v", PasswordAuthFailure, status, err)
+		}
+	}
+	if _, err := login("secret"); err == nil {
+		t.Fatalf("should refuse a banned client")
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if status, err := login("secret"); err != nil || status != PasswordAuthSuccess {
+		t.Fatalf("should get status %d once the ban expired but got %d, %v", PasswordAuthSuccess, status, err)
+	}
+}
+
+func TestIPKey(t *testing.T) {
+	if ipKey(net.ParseIP("::ffff:10.0.0.1")) != ipKey(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("should track an IPv4 address and its IPv6-mapped form together")
+	}
+}
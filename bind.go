@@ -0,0 +1,58 @@
+package socks5
+
+import (
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// requestBind listens for a single inbound connection on behalf of the
+// client. The first reply carries the address listened on, the second one
+// the address of the peer that connected.
+func requestBind(config *Config, info ConnInfo, conn io.ReadWriter) (net.Conn, error) {
+	localIP := addrIP(info.LocalAddr)
+	address := ":0"
+	if localIP != nil {
+		address = net.JoinHostPort(localIP.String(), "0")
+	}
+	listener, err := netListen(config, "tcp", address)
+	if err != nil {
+		log.Println(err.Error())
+		WriteRequestFailureMessage(conn, ReplyServerFailure)
+		return nil, err
+	}
+	defer listener.Close()
+
+	// First reply: the address the peer should connect to
+	addr := listener.Addr()
+	ip := addrIP(addr)
+	if config.AdvertisedIP != nil {
+		ip = config.AdvertisedIP
+	}
+	if err := writeBoundAddress(conn, config, ip, uint16(addrPort(addr))); err != nil {
+		return nil, err
+	}
+	if config.OnBindListen != nil {
+		config.OnBindListen(addr)
+	}
+
+	if config.BindTimeout > 0 {
+		if deadliner, ok := listener.(interface{ SetDeadline(time.Time) error }); ok {
+			deadliner.SetDeadline(time.Now().Add(config.BindTimeout))
+		}
+	}
+	peerConn, err := listener.Accept()
+	if err != nil {
+		WriteRequestFailureMessage(conn, ReplyTTLExpired)
+		return nil, err
+	}
+
+	// Second reply: the address of the peer
+	peerAddr := peerConn.RemoteAddr()
+	if err := WriteRequestSuccessMessage(conn, addrIP(peerAddr), uint16(addrPort(peerAddr))); err != nil {
+		peerConn.Close()
+		return nil, err
+	}
+	return peerConn, nil
+}
@@ -0,0 +1,82 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBind(t *testing.T) {
+	listening := make(chan net.Addr, 1)
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod:   MethodNoAuth,
+		BindTimeout:  2 * time.Second,
+		OnBindListen: func(addr net.Addr) { listening <- addr },
+	})
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy failure: %s", err)
+	}
+	defer conn.Close()
+	WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+	WriteClientRequestMessage(conn, &ClientRequestMessage{Cmd: CmdBind, AddrType: TypeIPv4, Address: "127.0.0.1"})
+	ReadServerAuthMessage(conn)
+	first, err := ReadServerReplyMessage(conn)
+	if err != nil || first.Reply != ReplySuccess {
+		t.Fatalf("should get first reply success but got %v, %v", first, err)
+	}
+
+	// The bound address is learned out of band and a peer connects to it
+	addr := <-listening
+	if addrPort(addr) != int(first.Port) {
+		t.Fatalf("should report the bound port %d but got %s", first.Port, addr)
+	}
+	peer, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("dial bound address failure: %s", err)
+	}
+	defer peer.Close()
+
+	second, err := ReadServerReplyMessage(conn)
+	if err != nil || second.Reply != ReplySuccess {
+		t.Fatalf("should get second reply success but got %v, %v", second, err)
+	}
+	if int(second.Port) != addrPort(peer.LocalAddr()) {
+		t.Fatalf("should report the peer port %d but got %d", addrPort(peer.LocalAddr()), second.Port)
+	}
+
+	peer.Write([]byte("from peer"))
+	buf := make([]byte, len("from peer"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "from peer" {
+		t.Fatalf("should bridge peer data to the client but got %q, %v", buf, err)
+	}
+	conn.Write([]byte("from client"))
+	buf = make([]byte, len("from client"))
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "from client" {
+		t.Fatalf("should bridge client data to the peer but got %q, %v", buf, err)
+	}
+}
+
+func TestBindTimeout(t *testing.T) {
+	_, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth, BindTimeout: 50 * time.Millisecond})
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy failure: %s", err)
+	}
+	defer conn.Close()
+	WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+	WriteClientRequestMessage(conn, &ClientRequestMessage{Cmd: CmdBind, AddrType: TypeIPv4, Address: "127.0.0.1"})
+	ReadServerAuthMessage(conn)
+	ReadServerReplyMessage(conn)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	second, err := ReadServerReplyMessage(conn)
+	if err != nil {
+		t.Fatalf("should get a second reply but got %s", err)
+	}
+	if second.Reply != ReplyTTLExpired {
+		t.Fatalf("should get reply %d but got %d", ReplyTTLExpired, second.Reply)
+	}
+}
@@ -0,0 +1,152 @@
+package socks5
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit open after repeated dial failures")
+
+// maxCircuitEntries is the number of tracked destinations above which stale
+// entries are pruned.
+const maxCircuitEntries = 1024
+
+// CircuitBreaker configures failing CONNECT requests fast to destinations
+// whose dials keep failing. After Failures consecutive dial failures within
+// Window the circuit of the destination opens, and requests to it are
+// refused with ReplyHostUnreachable for Cooldown. Then a single request is
+// let through to probe the destination: the circuit closes if it succeeds
+// and opens again if it fails. Destinations are named as for
+// MaxConnsPerDestination.
+type CircuitBreaker struct {
+	Failures int
+	Window   time.Duration // zero counts failures however far apart
+	Cooldown time.Duration
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuits tracks the circuit of every destination with recent failures.
+type circuits struct {
+	mu       sync.Mutex
+	settings CircuitBreaker
+	entries  map[string]*circuit
+}
+
+type circuit struct {
+	state        circuitState
+	failures     int
+	firstFailure time.Time // of the consecutive failures
+	openedAt     time.Time
+	probing      bool // a request is probing a half-open circuit
+}
+
+func newCircuits(config *Config) *circuits {
+	if config.CircuitBreaker == nil || config.CircuitBreaker.Failures <= 0 {
+		return nil
+	}
+	return &circuits{
+		settings: *config.CircuitBreaker,
+		entries:  make(map[string]*circuit),
+	}
+}
+
+// allow reports whether a request to the destination named key may dial it.
+// Every allowed request must be followed by a call to done.
+func (c *circuits) allow(key string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	switch entry.state {
+	case circuitOpen:
+		if time.Since(entry.openedAt) < c.settings.Cooldown {
+			return ErrCircuitOpen
+		}
+		entry.state = circuitHalfOpen
+		fallthrough
+	case circuitHalfOpen:
+		if entry.probing {
+			return ErrCircuitOpen
+		}
+		entry.probing = true
+	}
+	return nil
+}
+
+// done records the outcome of dialing the destination named key. Only
+// ErrConnectionRefused counts as a failure: other errors, such as the client
+// leaving, say nothing about the destination.
+func (c *circuits) done(key string, err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	entry, ok := c.entries[key]
+	if err == nil {
+		delete(c.entries, key)
+		return
+	}
+	if !errors.Is(err, ErrConnectionRefused) {
+		if ok {
+			entry.probing = false
+		}
+		return
+	}
+
+	if !ok {
+		c.prune(now)
+		entry = &circuit{}
+		c.entries[key] = entry
+	}
+	switch {
+	case entry.state == circuitOpen:
+		// A dial that started before the circuit opened
+		return
+	case entry.state == circuitHalfOpen:
+		entry.state, entry.openedAt, entry.probing = circuitOpen, now, false
+		return
+	case entry.failures == 0 || c.settings.Window > 0 && now.Sub(entry.firstFailure) > c.settings.Window:
+		entry.failures, entry.firstFailure = 0, now
+	}
+	if entry.failures++; entry.failures >= c.settings.Failures {
+		entry.state, entry.openedAt, entry.failures = circuitOpen, now, 0
+	}
+}
+
+// state returns the state of the circuit of the destination named key.
+func (c *circuits) state(key string) circuitState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok {
+		return entry.state
+	}
+	return circuitClosed
+}
+
+// prune forgets closed circuits whose failures are out of the window once
+// too many destinations are tracked.
+func (c *circuits) prune(now time.Time) {
+	if len(c.entries) < maxCircuitEntries || c.settings.Window <= 0 {
+		return
+	}
+	for key, entry := range c.entries {
+		if entry.state == circuitClosed && now.Sub(entry.firstFailure) > c.settings.Window {
+			delete(c.entries, key)
+		}
+	}
+}
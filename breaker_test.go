@@ -0,0 +1,90 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	c := newCircuits(&Config{CircuitBreaker: &CircuitBreaker{Failures: 2, Window: time.Second, Cooldown: 100 * time.Millisecond}})
+	const key = "example.com:80"
+	dial := func(err error) error {
+		if err := c.allow(key); err != nil {
+			return err
+		}
+		c.done(key, err)
+		return nil
+	}
+
+	// closed -> open
+	for i := 0; i < 2; i++ {
+		if err := dial(ErrConnectionRefused); err != nil {
+			t.Fatalf("should dial while closed but got %s", err)
+		}
+	}
+	if state := c.state(key); state != circuitOpen {
+		t.Fatalf("should get state %d but got %d", circuitOpen, state)
+	}
+	if err := dial(nil); err != ErrCircuitOpen {
+		t.Fatalf("should get error %s but got %v", ErrCircuitOpen, err)
+	}
+
+	// open -> half-open -> open
+	time.Sleep(150 * time.Millisecond)
+	if err := c.allow(key); err != nil {
+		t.Fatalf("should let a probe through after the cooldown but got %s", err)
+	}
+	if err := c.allow(key); err != ErrCircuitOpen {
+		t.Fatalf("should refuse a second probe but got %v", err)
+	}
+	c.done(key, ErrConnectionRefused)
+	if state := c.state(key); state != circuitOpen {
+		t.Fatalf("should get state %d after a failed probe but got %d", circuitOpen, state)
+	}
+
+	// open -> half-open -> closed
+	time.Sleep(150 * time.Millisecond)
+	if err := dial(nil); err != nil {
+		t.Fatalf("should let a probe through after the cooldown but got %s", err)
+	}
+	if state := c.state(key); state != circuitClosed {
+		t.Fatalf("should get state %d after a successful probe but got %d", circuitClosed, state)
+	}
+
+	// Failures are only consecutive within the window, and other errors
+	// don't count.
+	dial(ErrConnectionRefused)
+	dial(errors.New("client gone"))
+	dial(nil)
+	dial(ErrConnectionRefused)
+	if state := c.state(key); state != circuitClosed {
+		t.Fatalf("should get state %d but got %d", circuitClosed, state)
+	}
+}
+
+func TestCircuitBreakerRequests(t *testing.T) {
+	var dials int32
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod:     MethodNoAuth,
+		CircuitBreaker: &CircuitBreaker{Failures: 1, Cooldown: time.Minute},
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return nil, errors.New("backend down")
+		},
+	})
+	target := startEchoServer(t)
+
+	if _, reply := connectRequest(t, proxyAddr, target); reply.Reply != ReplyConnectionRefused {
+		t.Fatalf("should get reply %d but got %d", ReplyConnectionRefused, reply.Reply)
+	}
+	if _, reply := connectRequest(t, proxyAddr, target); reply.Reply != ReplyHostUnreachable {
+		t.Fatalf("should get reply %d once the circuit is open but got %d", ReplyHostUnreachable, reply.Reply)
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("should dial once but dialed %d times", n)
+	}
+}
@@ -0,0 +1,68 @@
+package socks5
+
+import "runtime"
+
+// Capabilities reported by SOCKS5Server.Capabilities.
+const (
+	CapabilityConnect           = "connect"             // SOCKS5 CONNECT
+	CapabilityBind              = "bind"                // SOCKS5 BIND
+	CapabilityUDPAssociate      = "udp_associate"       // SOCKS5 UDP ASSOCIATE
+	CapabilityNoAuth            = "no_auth"             // MethodNoAuth
+	CapabilityPassword          = "password"            // MethodPassword
+	CapabilityHostnameHint      = "hostname_hint"       // MethodHostnameHint
+	CapabilityClientDialTimeout = "client_dial_timeout" // MethodDialTimeout
+	CapabilityTransparent       = "transparent"         // Config.TransparentMode
+	CapabilitySOCKS4            = "socks4"              // a ProtocolSOCKS4 handler
+	CapabilityHTTPConnect       = "http_connect"        // a ProtocolHTTP handler
+	CapabilityTLS               = "tls"                 // Config.TLSConfig
+	CapabilityStreamMux         = "stream_mux"          // Config.StreamMuxer
+	CapabilityUpstreamProxy     = "upstream_proxy"      // Config.UpstreamProxy or UpstreamProxies
+)
+
+// Capabilities returns the optional features the server supports with its
+// current configuration on this platform, for operators and tooling to
+// check. Features the server lacks altogether, such as compression, are
+// never reported.
+func (s *SOCKS5Server) Capabilities() []string {
+	config := s.config()
+	if config == nil {
+		return nil
+	}
+	var caps []string
+	if config.TransparentMode {
+		// Transparent connections skip SOCKS altogether
+		if runtime.GOOS == "linux" {
+			caps = append(caps, CapabilityTransparent)
+		}
+	} else {
+		caps = append(caps, CapabilityConnect, CapabilityBind, CapabilityUDPAssociate)
+		if config.accepts(MethodNoAuth) {
+			caps = append(caps, CapabilityNoAuth)
+			if config.AcceptHostnameHint {
+				caps = append(caps, CapabilityHostnameHint)
+			}
+			if config.MaxClientDialTimeout > 0 {
+				caps = append(caps, CapabilityClientDialTimeout)
+			}
+		}
+		if config.accepts(MethodPassword) {
+			caps = append(caps, CapabilityPassword)
+		}
+		if config.ProtocolHandlers[ProtocolSOCKS4] != nil {
+			caps = append(caps, CapabilitySOCKS4)
+		}
+		if config.ProtocolHandlers[ProtocolHTTP] != nil {
+			caps = append(caps, CapabilityHTTPConnect)
+		}
+	}
+	if config.TLSConfig != nil {
+		caps = append(caps, CapabilityTLS)
+	}
+	if config.StreamMuxer != nil {
+		caps = append(caps, CapabilityStreamMux)
+	}
+	if config.UpstreamProxy != "" || len(config.UpstreamProxies) > 0 {
+		caps = append(caps, CapabilityUpstreamProxy)
+	}
+	return caps
+}
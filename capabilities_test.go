@@ -0,0 +1,49 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"net"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	handler := func(conn net.Conn) error { return nil }
+	transparent := []string(nil)
+	if runtime.GOOS == "linux" {
+		transparent = []string{CapabilityTransparent}
+	}
+	tests := []struct {
+		Name   string
+		Config *Config
+		Caps   []string
+	}{
+		{"default", &Config{AuthMethod: MethodNoAuth},
+			[]string{CapabilityConnect, CapabilityBind, CapabilityUDPAssociate, CapabilityNoAuth}},
+		{"enabled options", &Config{
+			AuthMethods:          []Method{MethodPassword, MethodNoAuth},
+			AcceptHostnameHint:   true,
+			MaxClientDialTimeout: 1,
+			ProtocolHandlers:     map[Protocol]func(conn net.Conn) error{ProtocolSOCKS4: handler, ProtocolHTTP: handler},
+			TLSConfig:            &tls.Config{},
+			UpstreamProxy:        "http://proxy:3128",
+		}, []string{
+			CapabilityConnect, CapabilityBind, CapabilityUDPAssociate,
+			CapabilityNoAuth, CapabilityHostnameHint, CapabilityClientDialTimeout, CapabilityPassword,
+			CapabilitySOCKS4, CapabilityHTTPConnect, CapabilityTLS, CapabilityUpstreamProxy,
+		}},
+		{"hint without no-auth", &Config{AuthMethod: MethodPassword, AcceptHostnameHint: true},
+			[]string{CapabilityConnect, CapabilityBind, CapabilityUDPAssociate, CapabilityPassword}},
+		{"transparent", &Config{TransparentMode: true}, transparent},
+		{"no config", nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			server := &SOCKS5Server{Config: test.Config}
+			if caps := server.Capabilities(); !reflect.DeepEqual(caps, test.Caps) {
+				t.Fatalf("should get capabilities %v but got %v", test.Caps, caps)
+			}
+		})
+	}
+}
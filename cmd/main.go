@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"os"
 	"strconv"
@@ -38,8 +39,9 @@ func main() {
 		},
 	}
 
+	// A drain through the admin API ends Run once the connections are done
 	err := server.Run()
-	if err != nil {
+	if err != nil && !errors.Is(err, socks5.ErrServerClosed) {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,614 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrConnectionNotFound = errors.New("connection not found")
+
+// ConnInfo describes an active client connection.
+type ConnInfo struct {
+	ID         string
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	// Method is the auth method the client authenticated with, zero
+	// (MethodNoAuth) until then
+	Method     Method
+	Username   string
+	Target     string
+	ServerName string // TLS SNI, see Config.InspectTLSSNI
+	// HostnameHint is the hostname sent by the client, see
+	// Config.AcceptHostnameHint
+	HostnameHint string
+	// Command is the command of the request, zero until it is read
+	Command   Command
+	StartTime time.Time
+	// Policy is the policy of the user, see Config.AuthChecker
+	Policy *UserPolicy
+}
+
+// CloseReason tells why a connection ended.
+type CloseReason string
+
+const (
+	CloseNormal          CloseReason = "normal"           // both sides finished
+	CloseHandshakeFailed CloseReason = "handshake_failed" // ended before a tunnel was set up
+	CloseIdleTimeout     CloseReason = "idle_timeout"     // see Config.ClientIdleTimeout and Config.IdleTimeout
+	CloseQuotaExceeded   CloseReason = "quota_exceeded"   // see Config.MaxBytesPerConn
+	CloseKicked          CloseReason = "kicked"           // closed with SOCKS5Server.Close
+	CloseTransportError  CloseReason = "transport_error"  // the client or the target connection failed
+)
+
+// ConnStats summarizes a finished connection.
+type ConnStats struct {
+	ConnInfo
+	BytesUp   int64 // client to target
+	BytesDown int64 // target to client
+	Duration  time.Duration
+	// DialLatency is the time spent connecting to the target, whether it
+	// succeeded or not. It is zero if no target was dialed.
+	DialLatency time.Duration
+	Err         error
+	// Reason is the first of the causes that ended the connection
+	Reason CloseReason
+	// Reply is the last reply sent to the request of the client, if
+	// Replied.
+	Reply   ReplyType
+	Replied bool
+
+	ctx context.Context
+}
+
+// Context returns the context of the connection, see Config.OnConnect.
+func (s ConnStats) Context() context.Context {
+	if s.ctx != nil {
+		return s.ctx
+	}
+	return context.Background()
+}
+
+// session holds the state of a single client connection while it is
+// registered with the server.
+type session struct {
+	mu     sync.Mutex
+	info   ConnInfo
+	conn   net.Conn
+	target io.Closer
+	closed bool
+	meter  *trafficMeter
+
+	// ctx is cancelled once the session is unregistered
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	dialLatency time.Duration
+	reply       ReplyType
+	replied     bool
+	dialTimeout time.Duration // asked for by the client, see MethodDialTimeout
+	reason      CloseReason
+
+	// authenticated tells whether info.Method was negotiated
+	authenticated bool
+
+	// server is the server the session is registered with, if any
+	server *SOCKS5Server
+}
+
+type sessionKey struct{}
+
+// serverFromContext returns the server of the session ctx belongs to, if any.
+func serverFromContext(ctx context.Context) *SOCKS5Server {
+	if s, ok := ctx.Value(sessionKey{}).(*session); ok {
+		return s.server
+	}
+	return nil
+}
+
+// ConnInfoFromContext returns the information on the connection ctx belongs
+// to as it stands, such as the auth method and username once the client
+// authenticated. ctx is one the server passes to hooks, e.g. Forwarder or
+// Request.Context.
+func ConnInfoFromContext(ctx context.Context) (ConnInfo, bool) {
+	if s, ok := ctx.Value(sessionKey{}).(*session); ok {
+		return s.snapshot(), true
+	}
+	return ConnInfo{}, false
+}
+
+// recordDialLatency stores the time spent dialing since start in the session
+// ctx belongs to, if any.
+func recordDialLatency(ctx context.Context, start time.Time) {
+	if s, ok := ctx.Value(sessionKey{}).(*session); ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.dialLatency = time.Since(start)
+	}
+}
+
+// recordCommand stores the command of the request in the session ctx
+// belongs to, if any.
+func recordCommand(ctx context.Context, cmd Command) {
+	if s, ok := ctx.Value(sessionKey{}).(*session); ok {
+		s.setCommand(cmd)
+	}
+}
+
+func (s *session) setCommand(cmd Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.info.Command = cmd
+}
+
+func (s *session) setReply(reply ReplyType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reply, s.replied = reply, true
+}
+
+// replyWriter records in sess the reply code of every reply written to the
+// client. Replies are written at once, so every write is a reply.
+type replyWriter struct {
+	io.ReadWriter
+	sess *session
+}
+
+func (w *replyWriter) Write(p []byte) (int, error) {
+	if len(p) > 1 && p[0] == SOCKS5Version {
+		w.sess.setReply(p[1])
+	}
+	return w.ReadWriter.Write(p)
+}
+
+func (s *session) setContext(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+}
+
+// context returns the context of the session.
+func (s *session) context() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx != nil {
+		return s.ctx
+	}
+	return context.Background()
+}
+
+// admit applies the authentication result to the session, unless the
+// connection limits of its auth method or of its user are reached.
+func (s *session) admit(result AuthResult, config *Config) error {
+	if s.server == nil {
+		s.setAuthResult(result)
+		return nil
+	}
+	return s.server.admit(s, result, config)
+}
+
+// authMethod returns the auth method of the session, or MethodNoAcceptable
+// until it is authenticated.
+func (s *session) authMethod() Method {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authenticated {
+		return MethodNoAcceptable
+	}
+	return s.info.Method
+}
+
+func (s *session) setAuthResult(result AuthResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.info.Username = result.Username
+	s.info.Policy = result.Policy
+	s.info.Method, s.authenticated = result.Method, true
+	s.dialTimeout = result.dialTimeout
+	if result.Policy != nil && result.Policy.MaxBytesPerConn > 0 {
+		s.meter.limit = result.Policy.MaxBytesPerConn
+	}
+}
+
+func (s *session) setHostnameHint(hint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.info.HostnameHint = hint
+}
+
+func (s *session) setServerName(serverName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.info.ServerName = serverName
+}
+
+// setCloseReason records why the session is ending, keeping the first cause.
+func (s *session) setCloseReason(reason CloseReason) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+}
+
+// closeReason returns the reason the session ended with err.
+func (s *session) closeReason(err error) CloseReason {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.reason != "":
+		return s.reason
+	case err == nil:
+		return CloseNormal
+	case errors.Is(err, ErrIdleTimeout):
+		return CloseIdleTimeout
+	case errors.Is(err, ErrQuotaExceeded):
+		return CloseQuotaExceeded
+	case s.target == nil:
+		return CloseHandshakeFailed
+	}
+	return CloseTransportError
+}
+
+// setTarget records the target of the session. If the session has already
+// been closed the target connection is closed immediately.
+func (s *session) setTarget(address string, target io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.info.Target = address
+	s.target = target
+	if s.closed {
+		target.Close()
+	}
+}
+
+func (s *session) snapshot() ConnInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info
+}
+
+// stats returns the statistics of the session, which finished with err.
+func (s *session) stats(err error) ConnStats {
+	s.mu.Lock()
+	reply, replied := s.reply, s.replied
+	s.mu.Unlock()
+	return ConnStats{
+		ConnInfo:    s.snapshot(),
+		BytesUp:     s.meter.BytesUp(),
+		BytesDown:   s.meter.BytesDown(),
+		Duration:    time.Since(s.info.StartTime),
+		DialLatency: s.latency(),
+		Err:         err,
+		Reason:      s.closeReason(err),
+		Reply:       reply,
+		Replied:     replied,
+		ctx:         s.context(),
+	}
+}
+
+func (s *session) latency() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dialLatency
+}
+
+// close closes both the client and the target connection, which interrupts
+// any forwarding in progress, and cancels the context of the session, which
+// aborts the lookups and dials in progress.
+func (s *session) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+	err := s.conn.Close()
+	if s.target != nil {
+		s.target.Close()
+	}
+	return err
+}
+
+// register adds a session for conn to the server, with a context derived
+// from parent. It returns nil if the server is draining or already serves
+// config.MaxConnections.
+func (s *SOCKS5Server) register(parent context.Context, conn net.Conn, config *Config) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return nil
+	}
+	if config.MaxConnections > 0 && len(s.sessions) >= config.MaxConnections {
+		log.Printf("connection limit reached, rejecting %s", conn.RemoteAddr())
+		return nil
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[string]*session)
+	}
+	s.nextID++
+	ctx, cancel := context.WithCancel(parent)
+	sess := &session{
+		server: s,
+		conn:   conn,
+		meter:  &trafficMeter{limit: config.MaxBytesPerConn},
+		ctx:    ctx,
+		cancel: cancel,
+		info: ConnInfo{
+			ID:         strconv.FormatUint(s.nextID, 10),
+			RemoteAddr: conn.RemoteAddr(),
+			LocalAddr:  conn.LocalAddr(),
+			StartTime:  time.Now(),
+		},
+	}
+	sess.ctx = context.WithValue(ctx, sessionKey{}, sess)
+	sess.meter.touch()
+	s.sessions[sess.info.ID] = sess
+	s.wg.Add(1)
+	if s.janitorDone == nil {
+		s.janitorDone = make(chan struct{})
+		go s.runJanitor(s.janitorDone)
+	}
+	return sess
+}
+
+// admit applies the authentication result to sess unless the connections
+// with its auth method or of its user are already at their limit.
+func (s *SOCKS5Server) admit(sess *session, result AuthResult, config *Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if result.Method == MethodNoAuth && config.MaxNoAuthConns > 0 {
+		count := 0
+		for _, other := range s.sessions {
+			if other != sess && other.authMethod() == MethodNoAuth {
+				count++
+			}
+		}
+		if count >= config.MaxNoAuthConns {
+			return ErrNoAuthConnectionLimit
+		}
+	}
+	if policy := result.Policy; policy != nil && policy.MaxConnections > 0 {
+		count := 0
+		for _, other := range s.sessions {
+			if other != sess && other.snapshot().Username == result.Username {
+				count++
+			}
+		}
+		if count >= policy.MaxConnections {
+			return ErrUserConnectionLimit
+		}
+	}
+	sess.setAuthResult(result)
+	return nil
+}
+
+func (s *SOCKS5Server) unregister(sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sess.info.ID)
+	sess.cancel()
+	s.closedBytesUp += sess.meter.BytesUp()
+	s.closedBytesDown += sess.meter.BytesDown()
+	s.wg.Done()
+	if len(s.sessions) == 0 && s.janitorDone != nil {
+		close(s.janitorDone)
+		s.janitorDone = nil
+	}
+	s.slotFreedLocked().Broadcast()
+}
+
+func (s *SOCKS5Server) slotFreedLocked() *sync.Cond {
+	if s.slotFreed == nil {
+		s.slotFreed = sync.NewCond(&s.mu)
+	}
+	return s.slotFreed
+}
+
+// waitForSlot blocks while the server serves max connections or more,
+// unless it is draining.
+func (s *SOCKS5Server) waitForSlot(max int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.sessions) >= max && !s.draining {
+		s.slotFreedLocked().Wait()
+	}
+}
+
+// URL returns a URL such as "socks5://127.0.0.1:1080" to reach the server
+// by, or an empty string if it is not listening. When the server listens on
+// several addresses one of them is used, with a wildcard IP replaced by the
+// loopback address. When password auth is among the accepted methods the
+// URL holds the placeholder credentials "user:password".
+func (s *SOCKS5Server) URL() string {
+	s.mu.Lock()
+	var addr net.Addr
+	for listener := range s.listeners {
+		addr = listener.Addr()
+		break
+	}
+	s.mu.Unlock()
+	if addr == nil {
+		return ""
+	}
+
+	host := addr.String()
+	if ip := addrIP(addr); ip != nil {
+		if ip.IsUnspecified() {
+			ip = net.IPv4(127, 0, 0, 1)
+			if addrIP(addr).To4() == nil {
+				ip = net.IPv6loopback
+			}
+		}
+		host = net.JoinHostPort(ip.String(), strconv.Itoa(addrPort(addr)))
+	}
+	u := url.URL{Scheme: "socks5", Host: host}
+	if config := s.config(); config != nil && config.accepts(MethodPassword) {
+		u.User = url.UserPassword("user", "password")
+	}
+	return u.String()
+}
+
+// ConnectionCount returns the number of connections currently served.
+func (s *SOCKS5Server) ConnectionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// trackListener records a listener served by the server so that draining can
+// close it. It returns false if the server is already draining.
+func (s *SOCKS5Server) trackListener(listener net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[listener] = struct{}{}
+	return true
+}
+
+// isOwnAddress reports whether ip and port name a listener of the server.
+// Listeners on an unspecified IP are reached through any local address.
+func (s *SOCKS5Server) isOwnAddress(ip net.IP, port int) bool {
+	s.mu.Lock()
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for listener := range s.listeners {
+		addrs = append(addrs, listener.Addr())
+	}
+	s.mu.Unlock()
+
+	// The interfaces are listed outside the lock, as it is a system call
+	for _, addr := range addrs {
+		if addrPort(addr) != port {
+			continue
+		}
+		listenIP := addrIP(addr)
+		if listenIP.Equal(ip) || listenIP != nil && listenIP.IsUnspecified() && isLocalIP(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalIP reports whether ip is an address of this host.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SOCKS5Server) untrackListener(listener net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, listener)
+}
+
+func (s *SOCKS5Server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// Drain stops accepting new connections and waits for the active ones to
+// finish.
+func (s *SOCKS5Server) Drain() {
+	s.DrainContext(context.Background())
+}
+
+// DrainContext stops accepting new connections and waits for the active ones
+// to finish. If ctx is done first, it returns the number of connections
+// still active together with the context error.
+func (s *SOCKS5Server) DrainContext(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	s.draining = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	s.slotFreedLocked().Broadcast()
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.sessions), ctx.Err()
+	}
+}
+
+// ActiveConnections returns a snapshot of the connections currently served.
+func (s *SOCKS5Server) ActiveConnections() []ConnInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos := make([]ConnInfo, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		infos = append(infos, sess.snapshot())
+	}
+	return infos
+}
+
+// ServerStats summarizes the connections served since the server started.
+type ServerStats struct {
+	ActiveConnections int    `json:"active_connections"`
+	TotalConnections  uint64 `json:"total_connections"`
+	BytesUp           int64  `json:"bytes_up"`   // client to target
+	BytesDown         int64  `json:"bytes_down"` // target to client
+	DroppedEvents     uint64 `json:"dropped_events"`
+}
+
+// Stats returns the statistics of the server, including the bytes forwarded
+// so far by active connections.
+func (s *SOCKS5Server) Stats() ServerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := ServerStats{
+		ActiveConnections: len(s.sessions),
+		TotalConnections:  s.nextID,
+		BytesUp:           s.closedBytesUp,
+		BytesDown:         s.closedBytesDown,
+		DroppedEvents:     s.droppedEvents,
+	}
+	for _, sess := range s.sessions {
+		stats.BytesUp += sess.meter.BytesUp()
+		stats.BytesDown += sess.meter.BytesDown()
+	}
+	return stats
+}
+
+// Close forcibly closes the active connection with the given ID.
+func (s *SOCKS5Server) Close(id string) error {
+	s.mu.Lock()
+	sess, ok := s.sessions[id]
+	s.mu.Unlock()
+	if !ok {
+		return ErrConnectionNotFound
+	}
+	sess.setCloseReason(CloseKicked)
+	return sess.close()
+}
@@ -0,0 +1,455 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCloseConnection(t *testing.T) {
+	server, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth})
+	target := startEchoServer(t)
+	conn := dialConnect(t, proxyAddr, target)
+
+	var infos []ConnInfo
+	for i := 0; i < 100; i++ {
+		if infos = server.ActiveConnections(); len(infos) == 1 && infos[0].Target != "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(infos) != 1 || infos[0].Target != target {
+		t.Fatalf("should get one connection to %s but got %v", target, infos)
+	}
+
+	if err := server.Close(infos[0].ID); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("should get error EOF but got %v", err)
+	}
+
+	for i := 0; i < 100 && len(server.ActiveConnections()) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if infos := server.ActiveConnections(); len(infos) != 0 {
+		t.Fatalf("should get no connection but got %v", infos)
+	}
+	if err := server.Close(infos[0].ID); err != ErrConnectionNotFound {
+		t.Fatalf("should get error %s but got %v", ErrConnectionNotFound, err)
+	}
+}
+
+func TestDrainContext(t *testing.T) {
+	server, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth})
+	target := startEchoServer(t)
+	conn := dialConnect(t, proxyAddr, target)
+	defer conn.Close()
+
+	for i := 0; i < 100 && len(server.ActiveConnections()) != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	remaining, err := server.DrainContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("should get error %s but got %v", context.DeadlineExceeded, err)
+	}
+	if remaining != 1 {
+		t.Fatalf("should get 1 remaining connection but got %d", remaining)
+	}
+
+	// New connections are refused while the tunnel keeps working
+	if c, err := net.DialTimeout("tcp", proxyAddr, time.Second); err == nil {
+		c.Close()
+		t.Fatalf("should fail to connect to a draining server")
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write failure: %s", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("should get echo but got %s", err)
+	}
+
+	conn.Close()
+	remaining, err = server.DrainContext(context.Background())
+	if err != nil || remaining != 0 {
+		t.Fatalf("should get 0 remaining connections but got %d, %v", remaining, err)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	addrs := make(chan string, 1)
+	server := &SOCKS5Server{Config: &Config{
+		AuthMethod: MethodNoAuth,
+		Listen: func(network, address string) (net.Listener, error) {
+			listener, err := net.Listen(network, "127.0.0.1:0")
+			if err == nil {
+				addrs <- listener.Addr().String()
+			}
+			return listener, err
+		},
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error, 1)
+	go func() { runErr <- server.RunContext(ctx) }()
+
+	proxyAddr := <-addrs
+	conn := dialConnect(t, proxyAddr, startEchoServer(t))
+	cancel()
+
+	// Run waits for the active connection to finish
+	select {
+	case err := <-runErr:
+		t.Fatalf("should wait for the active connection but got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if c, err := net.DialTimeout("tcp", proxyAddr, time.Second); err == nil {
+		c.Close()
+		t.Fatalf("should fail to connect to a draining server")
+	}
+
+	conn.Close()
+	select {
+	case err := <-runErr:
+		if err != context.Canceled {
+			t.Fatalf("should get error %s but got %v", context.Canceled, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("should return once the connection is done")
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	target := startEchoServer(t)
+
+	// handshake sends a no-auth method selection and waits up to timeout
+	// for the reply.
+	handshake := func(t *testing.T, proxyAddr string, timeout time.Duration) (net.Conn, error) {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("dial proxy failure: %s", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		_, err = ReadServerAuthMessage(conn)
+		return conn, err
+	}
+
+	t.Run("reject immediately", func(t *testing.T) {
+		server, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth, MaxConnections: 1})
+		dialConnect(t, proxyAddr, target)
+		if _, err := handshake(t, proxyAddr, 2*time.Second); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("should close the connection at once but got %v", err)
+		}
+		if count := server.ConnectionCount(); count != 1 {
+			t.Fatalf("should count 1 connection but got %d", count)
+		}
+	})
+
+	t.Run("pause accept", func(t *testing.T) {
+		_, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth, MaxConnections: 1, OnLimitReached: PauseAccept})
+		first := dialConnect(t, proxyAddr, target)
+		conn, err := handshake(t, proxyAddr, 100*time.Millisecond)
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("should wait for a free slot but got %v", err)
+		}
+
+		first.Close()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if method, err := ReadServerAuthMessage(conn); err != nil || method != MethodNoAuth {
+			t.Fatalf("should get method %d once a slot frees but got %d, %v", MethodNoAuth, method, err)
+		}
+	})
+}
+
+func TestURL(t *testing.T) {
+	t.Run("no auth", func(t *testing.T) {
+		server, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth})
+		for i := 0; i < 100 && server.URL() == ""; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if want := "socks5://" + proxyAddr; server.URL() != want {
+			t.Fatalf("should get URL %s but got %s", want, server.URL())
+		}
+	})
+
+	t.Run("password", func(t *testing.T) {
+		server, proxyAddr := startServer(t, &Config{
+			AuthMethod:      MethodPassword,
+			PasswordChecker: func(username, password string) bool { return password == "secret" },
+		})
+		for i := 0; i < 100 && server.URL() == ""; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if want := "socks5://user:password@" + proxyAddr; server.URL() != want {
+			t.Fatalf("should get URL %s but got %s", want, server.URL())
+		}
+	})
+
+	t.Run("password among methods", func(t *testing.T) {
+		server, proxyAddr := startServer(t, &Config{
+			AuthMethods:     []Method{MethodNoAuth, MethodPassword},
+			PasswordChecker: func(username, password string) bool { return password == "secret" },
+		})
+		for i := 0; i < 100 && server.URL() == ""; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if want := "socks5://user:password@" + proxyAddr; server.URL() != want {
+			t.Fatalf("should get URL %s but got %s", want, server.URL())
+		}
+	})
+
+	t.Run("wildcard address", func(t *testing.T) {
+		listener, err := net.Listen("tcp4", "0.0.0.0:0")
+		if err != nil {
+			t.Fatalf("listen failure: %s", err)
+		}
+		server := &SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth}}
+		if server.URL() != "" {
+			t.Fatalf("should get no URL before serving but got %s", server.URL())
+		}
+		go server.Serve(listener)
+		defer listener.Close()
+		for i := 0; i < 100 && server.URL() == ""; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		want := "socks5://127.0.0.1:" + strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+		if server.URL() != want {
+			t.Fatalf("should get URL %s but got %s", want, server.URL())
+		}
+	})
+}
+
+func TestUpdateConfig(t *testing.T) {
+	server, proxyAddr := startServer(t, &Config{
+		AuthMethod:      MethodPassword,
+		PasswordChecker: func(username, password string) bool { return password == "old" },
+	})
+
+	login := func(password string) byte {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("dial proxy failure: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodPassword}})
+		if _, err := ReadServerAuthMessage(conn); err != nil {
+			t.Fatalf("read auth reply failure: %s", err)
+		}
+		WriteClientPasswordMessage(conn, &ClientPasswordMessage{Username: "admin", Password: password})
+		status, err := ReadServerPasswordMessage(conn)
+		if err != nil {
+			t.Fatalf("read password reply failure: %s", err)
+		}
+		return status
+	}
+
+	if status := login("old"); status != PasswordAuthSuccess {
+		t.Fatalf("should get status %d but got %d", PasswordAuthSuccess, status)
+	}
+	if err := server.UpdateConfig(&Config{AuthMethod: MethodPassword}); err != ErrPasswordCheckerNotSet {
+		t.Fatalf("should get error %s but got %v", ErrPasswordCheckerNotSet, err)
+	}
+	err := server.UpdateConfig(&Config{
+		AuthMethod:      MethodPassword,
+		PasswordChecker: func(username, password string) bool { return password == "new" },
+	})
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if status := login("old"); status != PasswordAuthFailure {
+		t.Fatalf("should get status %d with the old password but got %d", PasswordAuthFailure, status)
+	}
+	if status := login("new"); status != PasswordAuthSuccess {
+		t.Fatalf("should get status %d with the new password but got %d", PasswordAuthSuccess, status)
+	}
+}
+
+func TestCloseReasonKicked(t *testing.T) {
+	closed := make(chan ConnStats, 1)
+	server, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodNoAuth,
+		OnClose:    func(stats ConnStats) { closed <- stats },
+	})
+	dialConnect(t, proxyAddr, startEchoServer(t))
+	if err := server.Close(server.ActiveConnections()[0].ID); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if stats := <-closed; stats.Reason != CloseKicked {
+		t.Fatalf("should get reason %s but got %s", CloseKicked, stats.Reason)
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	config := &Config{AuthMethod: MethodNoAuth}
+	if err := initConfig(config); err != nil {
+		t.Fatalf("init config failure: %s", err)
+	}
+	server := &SOCKS5Server{Config: config}
+	target := startEchoServer(t)
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- server.ServeConn(ctx, conn) }()
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	go func() {
+		WriteClientAuthMessage(client, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+		WriteClientRequestMessage(client, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeIPv4, Address: host, Port: uint16(portNum)})
+	}()
+	if _, err := ReadServerAuthMessage(client); err != nil {
+		t.Fatalf("read auth reply failure: %s", err)
+	}
+	if reply, err := ReadServerReplyMessage(client); err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should get reply %d but got %v, %v", ReplySuccess, reply, err)
+	}
+	if n := server.ConnectionCount(); n != 1 {
+		t.Fatalf("should count 1 connection but got %d", n)
+	}
+
+	go client.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("should get echo ping but got %q, %v", buf, err)
+	}
+
+	// Cancelling the context ends the connection
+	cancel()
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("should return once the context is cancelled")
+	}
+	if n := server.ConnectionCount(); n != 0 {
+		t.Fatalf("should count no connection but got %d", n)
+	}
+}
+
+// slowListener sleeps before every Accept.
+type slowListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+func (l slowListener) Accept() (net.Conn, error) {
+	time.Sleep(l.delay)
+	return l.Listener.Accept()
+}
+
+func TestAcceptorCount(t *testing.T) {
+	const burst = 8
+	serveBurst := func(acceptors int) time.Duration {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen failure: %s", err)
+		}
+		config := &Config{AuthMethod: MethodNoAuth, AcceptorCount: acceptors}
+		if err := initConfig(config); err != nil {
+			t.Fatalf("init config failure: %s", err)
+		}
+		server := &SOCKS5Server{Config: config}
+		served := make(chan error, 1)
+		go func() { served <- server.Serve(slowListener{listener, 20 * time.Millisecond}) }()
+
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < burst; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := net.Dial("tcp", listener.Addr().String())
+				if err != nil {
+					t.Errorf("dial proxy failure: %s", err)
+					return
+				}
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+				if _, err := ReadServerAuthMessage(conn); err != nil {
+					t.Errorf("read auth reply failure: %s", err)
+				}
+			}()
+		}
+		wg.Wait()
+		elapsed := time.Since(start)
+
+		// Closing the listener stops every acceptor
+		listener.Close()
+		select {
+		case <-served:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("should stop serving with %d acceptors once the listener is closed", acceptors)
+		}
+		return elapsed
+	}
+
+	baseline := serveBurst(1)
+	if elapsed := serveBurst(4); elapsed >= baseline {
+		t.Fatalf("should serve the burst faster than %v with 4 acceptors but took %v", baseline, elapsed)
+	}
+}
+
+// errorListener fails every Accept with the next of its errors.
+type errorListener struct {
+	net.Listener
+	errs chan error
+}
+
+func (l errorListener) Accept() (net.Conn, error) {
+	return nil, <-l.errs
+}
+
+func TestOnAcceptError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	errTransient, errFatal := errors.New("transient"), errors.New("fatal")
+	errs := make(chan error, 2)
+	errs <- errTransient
+	errs <- errFatal
+
+	var seen []error
+	config := &Config{
+		AuthMethod: MethodNoAuth,
+		OnAcceptError: func(err error) bool {
+			seen = append(seen, err)
+			return err == errFatal
+		},
+	}
+	if err := initConfig(config); err != nil {
+		t.Fatalf("init config failure: %s", err)
+	}
+	server := &SOCKS5Server{Config: config}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(errorListener{listener, errs}) }()
+
+	select {
+	case err := <-served:
+		if err != errFatal {
+			t.Fatalf("should stop with error %s but got %v", errFatal, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("should stop serving once the hook asks to")
+	}
+	if len(seen) != 2 || seen[0] != errTransient {
+		t.Fatalf("should retry after the transient error but got %v", seen)
+	}
+}
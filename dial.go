@@ -0,0 +1,91 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// newDialer returns the dialer used to connect to targets.
+func newDialer(config *Config) *net.Dialer {
+	dialer := &net.Dialer{}
+	if config.TargetTOS != 0 {
+		tos := config.TargetTOS
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			return setTOS(network, c, tos)
+		}
+	}
+	return dialer
+}
+
+// Retries of a dial from a fixed source port, see Config.SourcePort, while
+// the port is in use, e.g. by a previous connection in TIME_WAIT.
+const (
+	sourcePortRetries    = 3
+	sourcePortRetryDelay = 100 * time.Millisecond
+)
+
+// sourcePort returns the source port chosen for req by config.SourcePort,
+// zero for an ephemeral port.
+func sourcePort(config *Config, req *Request) int {
+	if config.SourcePort == nil {
+		return 0
+	}
+	return config.SourcePort(req)
+}
+
+// dialFromPort returns a dial function connecting from the local port,
+// retrying while the port is in use.
+func dialFromPort(config *Config, port int) func(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := newDialer(config)
+	dialer.LocalAddr = &net.TCPAddr{Port: port}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		for attempt := 0; ; attempt++ {
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err == nil || !errors.Is(err, syscall.EADDRINUSE) || attempt == sourcePortRetries {
+				return conn, err
+			}
+			select {
+			case <-time.After(sourcePortRetryDelay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
+
+// targetTLS returns the TLS configuration chosen for req by
+// config.TLSToTarget, with the requested host as the server name unless it
+// sets one.
+func targetTLS(config *Config, req *Request) *tls.Config {
+	if config.TLSToTarget == nil {
+		return nil
+	}
+	tlsConfig := config.TLSToTarget(req)
+	if tlsConfig == nil || tlsConfig.ServerName != "" {
+		return tlsConfig
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.ServerName = req.Address
+	return tlsConfig
+}
+
+// tlsDialer returns a dial function completing a TLS handshake over the
+// connections of dial.
+func tlsDialer(tlsConfig *tls.Config, dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
@@ -0,0 +1,131 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSourcePort(t *testing.T) {
+	// Pick a free port for the dial to come from
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	defer listener.Close()
+	remotePort := make(chan int, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		remotePort <- conn.RemoteAddr().(*net.TCPAddr).Port
+	}()
+
+	requested := make(chan string, 1)
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodNoAuth,
+		SourcePort: func(req *Request) int {
+			requested <- req.Address
+			return port
+		},
+	})
+	dialConnect(t, proxyAddr, listener.Addr().String())
+	if got := <-remotePort; got != port {
+		t.Fatalf("should dial from port %d but got %d", port, got)
+	}
+	if address := <-requested; address != "127.0.0.1" {
+		t.Fatalf("should pass the request for 127.0.0.1 but got %q", address)
+	}
+}
+
+// startTLSEchoServer starts a TLS echo server with a certificate for
+// example.com and 127.0.0.1, and returns its address and a pool trusting it.
+func startTLSEchoServer(t *testing.T) (string, *x509.CertPool) {
+	// Borrow the certificate of httptest
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	cert := ts.TLS.Certificates[0]
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	ts.Close()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String(), roots
+}
+
+func TestTLSToTarget(t *testing.T) {
+	target, roots := startTLSEchoServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	portNum, _ := net.LookupPort("tcp", port)
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodNoAuth,
+		Resolver:   staticResolver{"example.com": net.IPv4(127, 0, 0, 1), "other.test": net.IPv4(127, 0, 0, 1)},
+		TLSToTarget: func(req *Request) *tls.Config {
+			return &tls.Config{RootCAs: roots}
+		},
+	})
+
+	connect := func(host string) (net.Conn, ReplyType) {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("dial proxy failure: %s", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+		ReadServerAuthMessage(conn)
+		WriteClientRequestMessage(conn, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeDomain, Address: host, Port: uint16(portNum)})
+		reply, err := ReadServerReplyMessage(conn)
+		if err != nil {
+			t.Fatalf("read reply failure: %s", err)
+		}
+		return conn, reply.Reply
+	}
+
+	t.Run("plaintext client", func(t *testing.T) {
+		conn, reply := connect("example.com")
+		if reply != ReplySuccess {
+			t.Fatalf("should get reply %d but got %d", ReplySuccess, reply)
+		}
+		conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("should get ping but got %q, %v", buf, err)
+		}
+	})
+
+	t.Run("certificate for another host", func(t *testing.T) {
+		if _, reply := connect("other.test"); reply != ReplyConnectionRefused {
+			t.Fatalf("should get reply %d but got %d", ReplyConnectionRefused, reply)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package socks5
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// DNS record types queried by DoHResolver.
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+)
+
+// DoHResolver resolves names with DNS over HTTPS, using the JSON API
+// supported by public resolvers such as https://cloudflare-dns.com/dns-query
+// and https://dns.google/resolve.
+type DoHResolver struct {
+	Endpoint string
+	Client   *http.Client // nil means http.DefaultClient
+}
+
+type dohResponse struct {
+	Status int
+	Answer []struct {
+		Type int    `json:"type"`
+		Data string `json:"data"`
+	}
+}
+
+// LookupIPAddr queries the A and AAAA records of host.
+func (r *DoHResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	var addrs []net.IPAddr
+	for _, recordType := range []int{dnsTypeA, dnsTypeAAAA} {
+		ips, err := r.query(ctx, host, recordType)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.IPAddr{IP: ip})
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("doh: no address for %s", host)
+	}
+	return addrs, nil
+}
+
+func (r *DoHResolver) query(ctx context.Context, host string, recordType int) ([]net.IP, error) {
+	query := url.Values{"name": {host}, "type": {fmt.Sprint(recordType)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.Endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-json")
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh: %s for %s", resp.Status, host)
+	}
+
+	var answer dohResponse
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, err
+	}
+	// A non-zero status is a DNS error such as NXDOMAIN (3)
+	if answer.Status != 0 {
+		return nil, fmt.Errorf("doh: rcode %d for %s", answer.Status, host)
+	}
+	var ips []net.IP
+	for _, record := range answer.Answer {
+		if record.Type != recordType {
+			continue // e.g. CNAME
+		}
+		if ip := net.ParseIP(record.Data); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
@@ -0,0 +1,66 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startDoHServer starts a stub DoH server answering for example.com only.
+func startDoHServer(t *testing.T) (*httptest.Server, *int32) {
+	t.Helper()
+	var queries int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		w.Header().Set("Content-Type", "application/dns-json")
+		if r.URL.Query().Get("name") != "example.com" {
+			fmt.Fprint(w, `{"Status":3}`)
+			return
+		}
+		switch r.URL.Query().Get("type") {
+		case "1":
+			fmt.Fprint(w, `{"Status":0,"Answer":[{"name":"example.com","type":5,"data":"alias.example.com."},{"name":"alias.example.com","type":1,"data":"93.184.216.34"}]}`)
+		case "28":
+			fmt.Fprint(w, `{"Status":0,"Answer":[{"name":"example.com","type":28,"data":"2606:2800:220:1::1"}]}`)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &queries
+}
+
+func TestDoHEndpoint(t *testing.T) {
+	server, queries := startDoHServer(t)
+	config := Config{
+		AuthMethod:        MethodNoAuth,
+		DoHEndpoint:       server.URL,
+		DNSCacheTTL:       time.Minute,
+		AddressPreference: PreferIPv4,
+	}
+	if err := initConfig(&config); err != nil {
+		t.Fatalf("init config failure: %s", err)
+	}
+
+	want := []net.IP{net.ParseIP("93.184.216.34"), net.ParseIP("2606:2800:220:1::1")}
+	for i := 0; i < 2; i++ {
+		ips, err := lookupIPs(context.Background(), "example.com", &config)
+		if err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+		if !reflect.DeepEqual(ips, want) {
+			t.Fatalf("should get %v but got %v", want, ips)
+		}
+	}
+	if n := atomic.LoadInt32(queries); n != 2 {
+		t.Fatalf("should query A and AAAA once through the cache but sent %d queries", n)
+	}
+
+	if _, err := lookupIPs(context.Background(), "missing.example.com", &config); err == nil {
+		t.Fatalf("should fail to resolve a missing name")
+	}
+}
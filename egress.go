@@ -0,0 +1,89 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+var ErrEgressLimitReached = errors.New("egress connection limit reached")
+
+// egressLimiter counts the target connections opened by CONNECT requests,
+// in total and per destination.
+type egressLimiter struct {
+	mu         sync.Mutex
+	total      int
+	perDest    map[string]int
+	maxTotal   int
+	maxPerDest int
+}
+
+func newEgressLimiter(config *Config) *egressLimiter {
+	if config.MaxTargetConns <= 0 && config.MaxConnsPerDestination <= 0 {
+		return nil
+	}
+	return &egressLimiter{
+		perDest:    make(map[string]int),
+		maxTotal:   config.MaxTargetConns,
+		maxPerDest: config.MaxConnsPerDestination,
+	}
+}
+
+// acquire takes a slot for a connection to the destination named key. The
+// returned function gives it back.
+func (l *egressLimiter) acquire(key string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return nil, ErrEgressLimitReached
+	}
+	if l.maxPerDest > 0 && l.perDest[key] >= l.maxPerDest {
+		return nil, ErrEgressLimitReached
+	}
+	l.total++
+	l.perDest[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if l.perDest[key]--; l.perDest[key] == 0 {
+				delete(l.perDest, key)
+			}
+		})
+	}, nil
+}
+
+// destinationKey names the destination of req for MaxConnsPerDestination.
+func destinationKey(config *Config, req *Request) string {
+	if config.DestinationKey != nil {
+		return config.DestinationKey(req)
+	}
+	return net.JoinHostPort(req.Address, strconv.Itoa(int(req.Port)))
+}
+
+// egressConn is a target connection that gives its egress slot back when
+// closed.
+type egressConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *egressConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
+
+func (c *egressConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("half-close not supported")
+}
@@ -0,0 +1,43 @@
+package socks5
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaxConnsPerDestination(t *testing.T) {
+	_, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth, MaxConnsPerDestination: 2})
+	target := startEchoServer(t)
+	other := startEchoServer(t)
+
+	first := dialConnect(t, proxyAddr, target)
+	dialConnect(t, proxyAddr, target)
+	if _, reply := connectRequest(t, proxyAddr, target); reply.Reply != ReplyServerFailure {
+		t.Fatalf("should get reply %d but got %d", ReplyServerFailure, reply.Reply)
+	}
+	dialConnect(t, proxyAddr, other)
+
+	// Closing a tunnel frees its slot
+	first.Close()
+	var reply *ServerReplyMessage
+	for i := 0; i < 100; i++ {
+		if _, reply = connectRequest(t, proxyAddr, target); reply.Reply == ReplySuccess {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reply.Reply != ReplySuccess {
+		t.Fatalf("should get reply success after closing a tunnel but got %d", reply.Reply)
+	}
+}
+
+func TestMaxTargetConns(t *testing.T) {
+	_, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth, MaxTargetConns: 1})
+	target := startEchoServer(t)
+	other := startEchoServer(t)
+
+	dialConnect(t, proxyAddr, target)
+	if _, reply := connectRequest(t, proxyAddr, other); reply.Reply != ReplyServerFailure {
+		t.Fatalf("should get reply %d but got %d", ReplyServerFailure, reply.Reply)
+	}
+}
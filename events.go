@@ -0,0 +1,87 @@
+package socks5
+
+import (
+	"context"
+	"time"
+)
+
+// eventBufferSize is the number of events buffered for a slow consumer of
+// SOCKS5Server.Events before they are dropped.
+const eventBufferSize = 256
+
+// EventType is the kind of an Event.
+type EventType string
+
+const (
+	EventAccepted      EventType = "accepted"       // a client connection was accepted
+	EventAuthResult    EventType = "auth_result"    // the client authenticated, or failed to
+	EventRequestParsed EventType = "request_parsed" // the client sent its request
+	EventConnected     EventType = "connected"      // the target of the request was set up
+	EventClosed        EventType = "closed"         // the connection ended
+)
+
+// Event reports a step in the life of a client connection.
+type Event struct {
+	Type EventType
+	Time time.Time
+	Conn ConnInfo // the connection as of the event
+
+	// Request is the request of the client, for EventRequestParsed.
+	Request *ClientRequestMessage
+	// Stats summarizes the connection, for EventClosed.
+	Stats *ConnStats
+	// Err is the failure of the step, if any, for EventAuthResult and
+	// EventClosed.
+	Err error
+}
+
+// Events returns a channel receiving the events of the connections served
+// from now on. Events are dropped instead of slowing connections down when
+// the channel is full; DroppedEvents counts them.
+func (s *SOCKS5Server) Events() <-chan Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.events == nil {
+		s.events = make(chan Event, eventBufferSize)
+	}
+	return s.events
+}
+
+// DroppedEvents returns the number of events dropped because the consumer of
+// Events didn't keep up.
+func (s *SOCKS5Server) DroppedEvents() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.droppedEvents
+}
+
+// emit sends ev to the events channel, if any, without blocking.
+func (s *SOCKS5Server) emit(ev Event) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.events == nil {
+		return
+	}
+	ev.Time = time.Now()
+	select {
+	case s.events <- ev:
+	default:
+		s.droppedEvents++
+	}
+}
+
+// emit reports an event of the session to its server.
+func (s *session) emit(ev Event) {
+	ev.Conn = s.snapshot()
+	s.server.emit(ev)
+}
+
+// emitEvent reports an event of the session ctx belongs to, if any.
+func emitEvent(ctx context.Context, ev Event) {
+	if s, ok := ctx.Value(sessionKey{}).(*session); ok {
+		s.emit(ev)
+	}
+}
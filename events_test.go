@@ -0,0 +1,81 @@
+package socks5
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	server, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth})
+	events := server.Events()
+	target := startEchoServer(t)
+	conn := dialConnect(t, proxyAddr, target)
+	conn.Close()
+
+	var types []EventType
+	var closed Event
+	for closed.Type != EventClosed {
+		select {
+		case closed = <-events:
+			types = append(types, closed.Type)
+			if closed.Conn.ID != "1" {
+				t.Fatalf("should get events of connection 1 but got %s", closed.Conn.ID)
+			}
+			if closed.Type == EventRequestParsed && closed.Request.Port == 0 {
+				t.Fatalf("should get the parsed request but got %+v", closed.Request)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("should get event %s but got %v", EventClosed, types)
+		}
+	}
+	want := []EventType{EventAccepted, EventAuthResult, EventRequestParsed, EventConnected, EventClosed}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("should get events %v but got %v", want, types)
+	}
+	if closed.Stats == nil || closed.Conn.Target != target {
+		t.Fatalf("should get the stats of the connection to %s but got %+v", target, closed)
+	}
+	if dropped := server.DroppedEvents(); dropped != 0 {
+		t.Fatalf("should drop no events but dropped %d", dropped)
+	}
+}
+
+func TestEventsNormalizedHost(t *testing.T) {
+	target := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+	server, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodNoAuth,
+		Resolver:   staticResolver{"echo.test": net.IPv4(127, 0, 0, 1)},
+	})
+	events := server.Events()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy failure: %s", err)
+	}
+	defer conn.Close()
+	WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+	ReadServerAuthMessage(conn)
+	WriteClientRequestMessage(conn, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeDomain, Address: "Echo.Test.", Port: uint16(portNum)})
+	if reply, err := ReadServerReplyMessage(conn); err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should get reply success but got %v, %v", reply, err)
+	}
+
+	for {
+		select {
+		case event := <-events:
+			if event.Type != EventRequestParsed {
+				continue
+			}
+			if event.Request.Address != "echo.test" {
+				t.Fatalf("should get the normalized domain echo.test but got %q", event.Request.Address)
+			}
+			return
+		case <-time.After(2 * time.Second):
+			t.Fatalf("should get event %s", EventRequestParsed)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+var (
+	ErrGSSAPIAbort              = errors.New("gssapi negotiation aborted")
+	ErrGSSAPIUnexpectedMessage  = errors.New("unexpected gssapi message type")
+	ErrGSSAPIProtectionNotValid = errors.New("invalid gssapi protection level")
+)
+
+// GSSAPIVersion is the version of the GSSAPI messages of RFC 1961.
+const GSSAPIVersion = 0x01
+
+// Types of the GSSAPI messages exchanged after MethodGSSAPI is selected.
+const (
+	GSSAPIMessageAuth          = 0x01 // security context establishment
+	GSSAPIMessageProtection    = 0x02 // protection level negotiation
+	GSSAPIMessageEncapsulation = 0x03 // data protected per the level
+	GSSAPIMessageAbort         = 0xff
+)
+
+// GSSAPIProtection is the protection level of the messages following the
+// GSSAPI sub-negotiation.
+type GSSAPIProtection byte
+
+const (
+	GSSAPIIntegrity       GSSAPIProtection = 0x01 // required per-message integrity
+	GSSAPIConfidentiality GSSAPIProtection = 0x02 // required per-message integrity and confidentiality
+	GSSAPIPerMessage      GSSAPIProtection = 0x03 // selective per-message protection
+)
+
+// GSSAPIWrap protects messages with an established GSSAPI security context,
+// e.g. gss_wrap and gss_unwrap of a Kerberos implementation.
+type GSSAPIWrap interface {
+	// Wrap returns the token protecting data, encrypted when confidential.
+	Wrap(data []byte, confidential bool) ([]byte, error)
+	// Unwrap returns the data of a token from the peer.
+	Unwrap(token []byte) ([]byte, error)
+}
+
+// WriteGSSAPIMessage writes a GSSAPI message of type mtyp carrying token.
+func WriteGSSAPIMessage(conn io.Writer, mtyp byte, token []byte) error {
+	if len(token) > 0xffff {
+		return errors.New("gssapi token too long")
+	}
+	buf := make([]byte, 4, 4+len(token))
+	buf[0], buf[1] = GSSAPIVersion, mtyp
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(token)))
+	_, err := conn.Write(append(buf, token...))
+	return err
+}
+
+// ReadGSSAPIMessage reads a GSSAPI message and returns its type and token.
+// An abort message is returned as ErrGSSAPIAbort.
+func ReadGSSAPIMessage(conn io.Reader) (byte, []byte, error) {
+	// Read version and type, which is all an abort message has
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return 0, nil, err
+	}
+	if buf[0] != GSSAPIVersion {
+		return 0, nil, ErrMethodVersionNotSupported
+	}
+	mtyp := buf[1]
+	if mtyp == GSSAPIMessageAbort {
+		return mtyp, nil, ErrGSSAPIAbort
+	}
+
+	// Read token
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return 0, nil, err
+	}
+	token := make([]byte, binary.BigEndian.Uint16(buf))
+	if _, err := io.ReadFull(conn, token); err != nil {
+		return 0, nil, err
+	}
+	return mtyp, token, nil
+}
+
+// readGSSAPIProtection reads a protection level negotiation message.
+func readGSSAPIProtection(conn io.Reader, wrap GSSAPIWrap) (GSSAPIProtection, error) {
+	mtyp, token, err := ReadGSSAPIMessage(conn)
+	if err != nil {
+		return 0, err
+	}
+	if mtyp != GSSAPIMessageProtection {
+		return 0, ErrGSSAPIUnexpectedMessage
+	}
+	data, err := wrap.Unwrap(token)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 1 || data[0] < byte(GSSAPIIntegrity) || data[0] > byte(GSSAPIPerMessage) {
+		return 0, ErrGSSAPIProtectionNotValid
+	}
+	return GSSAPIProtection(data[0]), nil
+}
+
+// writeGSSAPIProtection writes a protection level negotiation message. The
+// level is only integrity protected, as RFC 1961 requires.
+func writeGSSAPIProtection(conn io.Writer, wrap GSSAPIWrap, level GSSAPIProtection) error {
+	token, err := wrap.Wrap([]byte{byte(level)}, false)
+	if err != nil {
+		return err
+	}
+	return WriteGSSAPIMessage(conn, GSSAPIMessageProtection, token)
+}
+
+// NegotiateGSSAPIProtection runs the server side of the protection level
+// sub-negotiation once the security context is established: it reads the
+// level asked for by the client and replies with the one choose returns for
+// it, which is then in force.
+func NegotiateGSSAPIProtection(conn io.ReadWriter, wrap GSSAPIWrap, choose func(requested GSSAPIProtection) GSSAPIProtection) (GSSAPIProtection, error) {
+	requested, err := readGSSAPIProtection(conn, wrap)
+	if err != nil {
+		return 0, err
+	}
+	level := choose(requested)
+	if err := writeGSSAPIProtection(conn, wrap, level); err != nil {
+		return 0, err
+	}
+	return level, nil
+}
+
+// RequestGSSAPIProtection runs the client side of the protection level
+// sub-negotiation: it asks for level and returns the one the server chose.
+func RequestGSSAPIProtection(conn io.ReadWriter, wrap GSSAPIWrap, level GSSAPIProtection) (GSSAPIProtection, error) {
+	if err := writeGSSAPIProtection(conn, wrap, level); err != nil {
+		return 0, err
+	}
+	return readGSSAPIProtection(conn, wrap)
+}
+
+// gssapiConn encapsulates the data of a connection in GSSAPI messages.
+type gssapiConn struct {
+	net.Conn
+	wrap         GSSAPIWrap
+	confidential bool
+
+	readMu  sync.Mutex
+	pending []byte // unwrapped data not read yet
+}
+
+// NewGSSAPIConn returns a connection protecting the data sent over conn
+// with wrap at the negotiated level, and unprotecting the data received.
+// Custom forwarders pass it to Forward instead of the client connection.
+func NewGSSAPIConn(conn net.Conn, wrap GSSAPIWrap, level GSSAPIProtection) net.Conn {
+	return &gssapiConn{Conn: conn, wrap: wrap, confidential: level == GSSAPIConfidentiality}
+}
+
+func (c *gssapiConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.pending) == 0 {
+		mtyp, token, err := ReadGSSAPIMessage(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		if mtyp != GSSAPIMessageEncapsulation {
+			return 0, ErrGSSAPIUnexpectedMessage
+		}
+		if c.pending, err = c.wrap.Unwrap(token); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// maxGSSAPIChunk bounds the data wrapped in a message, leaving room for the
+// overhead of the token within its 16-bit length.
+const maxGSSAPIChunk = 0xffff - 1024
+
+func (c *gssapiConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxGSSAPIChunk {
+			n = maxGSSAPIChunk
+		}
+		token, err := c.wrap.Wrap(b[:n], c.confidential)
+		if err != nil {
+			return written, err
+		}
+		if err := WriteGSSAPIMessage(c.Conn, GSSAPIMessageEncapsulation, token); err != nil {
+			return written, err
+		}
+		written, b = written+n, b[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the underlying connection if it supports it.
+func (c *gssapiConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("half-close not supported")
+}
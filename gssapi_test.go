@@ -0,0 +1,124 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// xorWrap is a stub GSSAPIWrap: tokens are the data XORed with a key,
+// prefixed with 1 when confidential.
+type xorWrap byte
+
+func (w xorWrap) Wrap(data []byte, confidential bool) ([]byte, error) {
+	token := []byte{0}
+	if confidential {
+		token[0] = 1
+	}
+	for _, b := range data {
+		token = append(token, b^byte(w))
+	}
+	return token, nil
+}
+
+func (w xorWrap) Unwrap(token []byte) ([]byte, error) {
+	if len(token) == 0 {
+		return nil, errors.New("empty token")
+	}
+	data := make([]byte, 0, len(token)-1)
+	for _, b := range token[1:] {
+		data = append(data, b^byte(w))
+	}
+	return data, nil
+}
+
+func TestGSSAPIProtection(t *testing.T) {
+	wrap := xorWrap(0x5a)
+	tests := []struct {
+		Name      string
+		Requested GSSAPIProtection
+		Choose    func(GSSAPIProtection) GSSAPIProtection
+		Want      GSSAPIProtection
+	}{
+		{"accepted", GSSAPIConfidentiality, func(level GSSAPIProtection) GSSAPIProtection { return level }, GSSAPIConfidentiality},
+		{"downgraded", GSSAPIConfidentiality, func(GSSAPIProtection) GSSAPIProtection { return GSSAPIIntegrity }, GSSAPIIntegrity},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			negotiated := make(chan GSSAPIProtection, 1)
+			go func() {
+				level, err := NegotiateGSSAPIProtection(server, wrap, test.Choose)
+				if err != nil {
+					server.Close()
+				}
+				negotiated <- level
+			}()
+
+			level, err := RequestGSSAPIProtection(client, wrap, test.Requested)
+			if err != nil || level != test.Want {
+				t.Fatalf("should get level %d but got %d, %v", test.Want, level, err)
+			}
+			if level := <-negotiated; level != test.Want {
+				t.Fatalf("server should get level %d but got %d", test.Want, level)
+			}
+		})
+	}
+
+	t.Run("invalid level", func(t *testing.T) {
+		var buf bytes.Buffer
+		token, _ := wrap.Wrap([]byte{0x07}, false)
+		WriteGSSAPIMessage(&buf, GSSAPIMessageProtection, token)
+		if _, err := NegotiateGSSAPIProtection(&buf, wrap, nil); err != ErrGSSAPIProtectionNotValid {
+			t.Fatalf("should get error %s but got %v", ErrGSSAPIProtectionNotValid, err)
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		buf := bytes.NewBuffer([]byte{GSSAPIVersion, GSSAPIMessageAbort})
+		if _, err := NegotiateGSSAPIProtection(buf, wrap, nil); err != ErrGSSAPIAbort {
+			t.Fatalf("should get error %s but got %v", ErrGSSAPIAbort, err)
+		}
+	})
+}
+
+func TestGSSAPIForward(t *testing.T) {
+	wrap := xorWrap(0x5a)
+	client, proxyClient := net.Pipe()
+	proxyTarget, target := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- forward(NewGSSAPIConn(proxyClient, wrap, GSSAPIConfidentiality), proxyTarget, forwardOptions{})
+	}()
+	go func() {
+		defer target.Close()
+		io.Copy(target, target)
+	}()
+
+	// The client speaks encapsulated messages, the target plain data
+	conn := NewGSSAPIConn(client, wrap, GSSAPIConfidentiality)
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write failure: %s", err)
+	}
+	mtyp, token, err := ReadGSSAPIMessage(client)
+	if err != nil || mtyp != GSSAPIMessageEncapsulation {
+		t.Fatalf("should get an encapsulation message but got type %#x, %v", mtyp, err)
+	}
+	if token[0] != 1 {
+		t.Fatalf("should wrap the data confidentially at level %d", GSSAPIConfidentiality)
+	}
+	if data, _ := wrap.Unwrap(token); string(data) != "ping" {
+		t.Fatalf("should get ping but got %q", data)
+	}
+
+	client.Close()
+	target.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("should get no error for a clean close but got %s", err)
+	}
+}
@@ -0,0 +1,66 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+)
+
+// MethodHostnameHint is a private method, in the range RFC 1928 reserves for
+// them, that behaves like MethodNoAuth except that the client then sends the
+// hostname it resolved the target from. Servers with Config.AcceptHostnameHint
+// select it when offered; others ignore it and select MethodNoAuth, in which
+// case the client sends no hint.
+const MethodHostnameHint Method = 0x80
+
+const (
+	HostnameHintVersion = 0x01
+	HostnameHintSuccess = 0x00
+)
+
+// NewClientHostnameHintMessage reads the hostname hint sent by a client that
+// negotiated MethodHostnameHint.
+func NewClientHostnameHintMessage(conn io.Reader) (string, error) {
+	// Read version and hostname length
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+	if buf[0] != HostnameHintVersion {
+		return "", ErrMethodVersionNotSupported
+	}
+
+	// Read hostname
+	buf = make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// WriteClientHostnameHintMessage writes the hostname hint sent by a client
+// after the server selected MethodHostnameHint.
+func WriteClientHostnameHintMessage(conn io.Writer, hostname string) error {
+	if len(hostname) > 255 {
+		return errors.New("hostname too long")
+	}
+	buf := append([]byte{HostnameHintVersion, byte(len(hostname))}, hostname...)
+	_, err := conn.Write(buf)
+	return err
+}
+
+func WriteServerHostnameHintMessage(conn io.Writer, status byte) error {
+	_, err := conn.Write([]byte{HostnameHintVersion, status})
+	return err
+}
+
+// ReadServerHostnameHintMessage reads the status of a hostname hint.
+func ReadServerHostnameHintMessage(conn io.Reader) (byte, error) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return 0, err
+	}
+	if buf[0] != HostnameHintVersion {
+		return 0, ErrMethodVersionNotSupported
+	}
+	return buf[1], nil
+}
@@ -0,0 +1,77 @@
+package socks5
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+// hintHandshake offers MethodHostnameHint and MethodNoAuth to the proxy at
+// proxyAddr, sends hostname if the hint is accepted and connects to target.
+func hintHandshake(t *testing.T, proxyAddr, target, hostname string) (net.Conn, Method) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy failure: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodHostnameHint, MethodNoAuth}})
+	method, err := ReadServerAuthMessage(conn)
+	if err != nil {
+		t.Fatalf("read auth reply failure: %s", err)
+	}
+	if method == MethodHostnameHint {
+		if err := WriteClientHostnameHintMessage(conn, hostname); err != nil {
+			t.Fatalf("write hint failure: %s", err)
+		}
+		if status, err := ReadServerHostnameHintMessage(conn); err != nil || status != HostnameHintSuccess {
+			t.Fatalf("should get hint status success but got %d, %v", status, err)
+		}
+	}
+
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+	WriteClientRequestMessage(conn, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeIPv4, Address: host, Port: uint16(portNum)})
+	if reply, err := ReadServerReplyMessage(conn); err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should get reply success but got %v, %v", reply, err)
+	}
+	return conn, method
+}
+
+func TestHostnameHint(t *testing.T) {
+	target := startEchoServer(t)
+
+	t.Run("accepted", func(t *testing.T) {
+		closed := make(chan ConnStats, 1)
+		_, proxyAddr := startServer(t, &Config{
+			AuthMethod:         MethodNoAuth,
+			AcceptHostnameHint: true,
+			OnClose:            func(stats ConnStats) { closed <- stats },
+		})
+		conn, method := hintHandshake(t, proxyAddr, target, "echo.example.com")
+		if method != MethodHostnameHint {
+			t.Fatalf("should get method %d but got %d", MethodHostnameHint, method)
+		}
+		conn.Close()
+		if stats := <-closed; stats.HostnameHint != "echo.example.com" {
+			t.Fatalf("should get hostname hint echo.example.com but got %q", stats.HostnameHint)
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		closed := make(chan ConnStats, 1)
+		_, proxyAddr := startServer(t, &Config{
+			AuthMethod: MethodNoAuth,
+			OnClose:    func(stats ConnStats) { closed <- stats },
+		})
+		conn, method := hintHandshake(t, proxyAddr, target, "echo.example.com")
+		if method != MethodNoAuth {
+			t.Fatalf("should get method %d but got %d", MethodNoAuth, method)
+		}
+		conn.Close()
+		if stats := <-closed; stats.HostnameHint != "" {
+			t.Fatalf("should get no hostname hint but got %q", stats.HostnameHint)
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package socks5
+
+import (
+	"log"
+	"time"
+)
+
+// defaultIdleSweepInterval is how often idle connections are swept when
+// Config.IdleSweepInterval is not set.
+const defaultIdleSweepInterval = time.Second
+
+// runJanitor closes the connections idle for longer than Config.IdleTimeout
+// until done is closed. It reads the configuration on every sweep, so that
+// UpdateConfig changes the timeout and the interval of the next ones.
+func (s *SOCKS5Server) runJanitor(done <-chan struct{}) {
+	for {
+		interval := s.config().IdleSweepInterval
+		if interval <= 0 {
+			interval = defaultIdleSweepInterval
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+			if timeout := s.config().IdleTimeout; timeout > 0 {
+				s.sweepIdle(timeout)
+			}
+		case <-done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// sweepIdle closes the connections that forwarded nothing for timeout.
+func (s *SOCKS5Server) sweepIdle(timeout time.Duration) {
+	deadline := time.Now().Add(-timeout)
+	var idle []*session
+	s.mu.Lock()
+	for _, sess := range s.sessions {
+		if sess.meter.idleSince().Before(deadline) {
+			idle = append(idle, sess)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, sess := range idle {
+		log.Printf("closing connection %s idle since %v", sess.info.ID, sess.meter.idleSince())
+		sess.setCloseReason(CloseIdleTimeout)
+		sess.close()
+	}
+}
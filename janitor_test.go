@@ -0,0 +1,109 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIdleJanitor(t *testing.T) {
+	closed := make(chan ConnStats, 10)
+	server, proxyAddr := startServer(t, &Config{
+		AuthMethod:        MethodNoAuth,
+		OnClose:           func(stats ConnStats) { closed <- stats },
+		IdleTimeout:       300 * time.Millisecond,
+		IdleSweepInterval: 50 * time.Millisecond,
+	})
+	target := startEchoServer(t)
+
+	var active, idle []net.Conn
+	for i := 0; i < 10; i++ {
+		conn := dialConnect(t, proxyAddr, target)
+		if i%2 == 0 {
+			active = append(active, conn)
+		} else {
+			idle = append(idle, conn)
+		}
+	}
+
+	// Keep half of the connections busy past the idle timeout
+	buf := make([]byte, 4)
+	for end := time.Now().Add(800 * time.Millisecond); time.Now().Before(end); time.Sleep(50 * time.Millisecond) {
+		for _, conn := range active {
+			conn.SetDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatalf("should keep an active connection but got %s", err)
+			}
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Fatalf("should keep an active connection but got %s", err)
+			}
+		}
+	}
+
+	for _, conn := range idle {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(buf); err != io.EOF {
+			t.Fatalf("should close an idle connection but got %v", err)
+		}
+	}
+	// The closed connections are unregistered right after the client sees
+	// them close
+	for end := time.Now().Add(time.Second); server.ConnectionCount() != len(active) && time.Now().Before(end); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := server.ConnectionCount(); n != len(active) {
+		t.Fatalf("should keep %d connections but got %d", len(active), n)
+	}
+	for range idle {
+		if stats := <-closed; stats.Reason != CloseIdleTimeout {
+			t.Fatalf("should get reason %s but got %s", CloseIdleTimeout, stats.Reason)
+		}
+	}
+}
+
+func TestIdleJanitorServeConn(t *testing.T) {
+	closed := make(chan ConnStats, 1)
+	config := &Config{AuthMethod: MethodNoAuth, OnClose: func(stats ConnStats) { closed <- stats }}
+	if err := initConfig(config); err != nil {
+		t.Fatalf("init config failure: %s", err)
+	}
+	server := &SOCKS5Server{Config: config}
+	target := startEchoServer(t)
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	served := make(chan error, 1)
+	go func() { served <- server.ServeConn(context.Background(), conn) }()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	go func() {
+		WriteClientAuthMessage(client, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+		WriteClientRequestMessage(client, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeIPv4, Address: host, Port: uint16(portNum)})
+	}()
+	ReadServerAuthMessage(client)
+	if reply, err := ReadServerReplyMessage(client); err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should get reply %d but got %v, %v", ReplySuccess, reply, err)
+	}
+
+	// The idle timeout set afterwards applies to the connection already open
+	err := server.UpdateConfig(&Config{
+		AuthMethod:        MethodNoAuth,
+		IdleTimeout:       200 * time.Millisecond,
+		IdleSweepInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("update config failure: %s", err)
+	}
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("should close the idle connection")
+	}
+	if stats := <-closed; stats.Reason != CloseIdleTimeout {
+		t.Fatalf("should get reason %s but got %s", CloseIdleTimeout, stats.Reason)
+	}
+}
@@ -0,0 +1,34 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// listen announces on the local network address and applies the listener
+// options of config, including TLS.
+func listen(config *Config, network, address string) (net.Listener, error) {
+	listener, err := netListen(config, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if config.ListenBacklog > 0 {
+		if err := setBacklog(listener, config.ListenBacklog); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	if config.TLSConfig != nil {
+		listener = tls.NewListener(listener, config.TLSConfig)
+	}
+	return listener, nil
+}
+
+// netListen announces on the local network address with config.Listen, or
+// net.Listen if it is nil.
+func netListen(config *Config, network, address string) (net.Listener, error) {
+	if config.Listen != nil {
+		return config.Listen(network, address)
+	}
+	return net.Listen(network, address)
+}
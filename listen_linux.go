@@ -0,0 +1,29 @@
+//go:build linux
+
+package socks5
+
+import (
+	"net"
+	"syscall"
+)
+
+// setBacklog changes the accept backlog of listener. net.Listen always uses
+// the system maximum, so listen(2) is issued again on the socket, which Linux
+// allows in order to update the backlog.
+func setBacklog(listener net.Listener, backlog int) error {
+	tcpListener, ok := listener.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+	raw, err := tcpListener.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	if err := raw.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+	return listenErr
+}
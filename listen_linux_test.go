@@ -0,0 +1,27 @@
+//go:build linux
+
+package socks5
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenBacklog(t *testing.T) {
+	listener, err := listen(&Config{ListenBacklog: 16}, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		if conn, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("should accept after setting the backlog but got %s", err)
+	}
+	conn.Close()
+}
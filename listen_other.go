@@ -0,0 +1,12 @@
+//go:build !linux
+
+package socks5
+
+import (
+	"net"
+)
+
+// setBacklog is a no-op where the backlog cannot be changed.
+func setBacklog(listener net.Listener, backlog int) error {
+	return nil
+}
@@ -0,0 +1,83 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// staticResolver resolves the names it holds and fails for others.
+type staticResolver map[string]net.IP
+
+func (r staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ip, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return []net.IPAddr{{IP: ip}}, nil
+}
+
+func TestInMemory(t *testing.T) {
+	listener := newMemListener()
+	t.Cleanup(func() { listener.Close() })
+	dialed := make(chan string, 1)
+	server := &SOCKS5Server{Config: &Config{
+		AuthMethod: MethodNoAuth,
+		Listen: func(network, address string) (net.Listener, error) {
+			return listener, nil
+		},
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed <- address
+			client, target := net.Pipe()
+			go func() {
+				defer target.Close()
+				io.Copy(target, target)
+			}()
+			return client, nil
+		},
+		Resolver: staticResolver{"echo.test": net.IPv4(192, 0, 2, 7)},
+	}}
+	runErr := make(chan error, 1)
+	go func() { runErr <- server.Run() }()
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatalf("dial listener failure: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// net.Pipe is unbuffered, so every message is read before the next
+	// one is written
+	if err := WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodNoAuth}}); err != nil {
+		t.Fatalf("write auth message failure: %s", err)
+	}
+	if method, err := ReadServerAuthMessage(conn); err != nil || method != MethodNoAuth {
+		t.Fatalf("should get method %d but got %d, %v", MethodNoAuth, method, err)
+	}
+	if err := WriteClientRequestMessage(conn, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeDomain, Address: "echo.test", Port: 7}); err != nil {
+		t.Fatalf("write request failure: %s", err)
+	}
+	if reply, err := ReadServerReplyMessage(conn); err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should get reply success but got %v, %v", reply, err)
+	}
+	if address := <-dialed; address != "192.0.2.7:7" {
+		t.Fatalf("should dial 192.0.2.7:7 but got %s", address)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write data failure: %s", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("should get ping but got %q, %v", buf, err)
+	}
+
+	listener.Close()
+	if err := <-runErr; !errors.Is(err, net.ErrClosed) && !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("should get a closed listener error but got %v", err)
+	}
+}
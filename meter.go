@@ -0,0 +1,80 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+var ErrQuotaExceeded = errors.New("connection byte quota exceeded")
+
+// trafficMeter counts the bytes forwarded in each direction of a connection
+// and enforces its byte quota.
+type trafficMeter struct {
+	up    int64 // client to target
+	down  int64 // target to client
+	total int64 // bytes reserved against limit
+	limit int64 // 0 means unlimited
+	last  int64 // time of the last write in Unix nanoseconds
+}
+
+// touch records activity on the connection.
+func (m *trafficMeter) touch() {
+	atomic.StoreInt64(&m.last, time.Now().UnixNano())
+}
+
+// idleSince returns the time of the last activity on the connection.
+func (m *trafficMeter) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&m.last))
+}
+
+func (m *trafficMeter) BytesUp() int64 {
+	return atomic.LoadInt64(&m.up)
+}
+
+func (m *trafficMeter) BytesDown() int64 {
+	return atomic.LoadInt64(&m.down)
+}
+
+// writer returns w metered as one direction of the connection.
+func (m *trafficMeter) writer(w io.Writer, upstream bool) io.Writer {
+	counter := &m.down
+	if upstream {
+		counter = &m.up
+	}
+	return &meteredWriter{w: w, meter: m, counter: counter}
+}
+
+type meteredWriter struct {
+	w       io.Writer
+	meter   *trafficMeter
+	counter *int64
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	var quotaErr error
+	if w.meter.limit > 0 {
+		// Reserve the bytes first so both directions together never go past
+		// the limit, then write only the part that fits.
+		over := atomic.AddInt64(&w.meter.total, int64(len(p))) - w.meter.limit
+		if over > 0 {
+			allowed := int64(len(p)) - over
+			if allowed < 0 {
+				allowed = 0
+			}
+			p = p[:allowed]
+			quotaErr = ErrQuotaExceeded
+		}
+	}
+
+	n, err := w.w.Write(p)
+	atomic.AddInt64(w.counter, int64(n))
+	if n > 0 {
+		w.meter.touch()
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, quotaErr
+}
@@ -0,0 +1,113 @@
+package socks5
+
+import (
+	"net"
+	"time"
+)
+
+// Metrics receives measurements from the server. Implementations must be
+// safe for concurrent use.
+type Metrics interface {
+	IncDNSCacheHit()
+	IncDNSCacheMiss()
+	ObserveResolveLatency(d time.Duration)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) IncDNSCacheHit()                       {}
+func (nopMetrics) IncDNSCacheMiss()                      {}
+func (nopMetrics) ObserveResolveLatency(d time.Duration) {}
+
+// metricsOf returns config.Metrics, or a no-op implementation if it is nil.
+func metricsOf(config *Config) Metrics {
+	if config.Metrics != nil {
+		return config.Metrics
+	}
+	return nopMetrics{}
+}
+
+// DestinationMetrics is an optional interface of Metrics receiving the
+// measurements of every tunnel by destination. Destinations are named by
+// Config.MetricLabelFn so that the number of labels stays bounded.
+type DestinationMetrics interface {
+	ObserveTunnel(label string, bytesUp, bytesDown int64, d time.Duration)
+}
+
+// otherLabel is the label of destinations MetricLabelFn doesn't name.
+const otherLabel = "other"
+
+// metricLabel returns the label of the target host for metrics.
+func metricLabel(config *Config, host string) string {
+	if config.MetricLabelFn == nil {
+		return otherLabel
+	}
+	if label := config.MetricLabelFn(host); label != "" {
+		return label
+	}
+	return otherLabel
+}
+
+// observeTunnel reports a finished tunnel to config.Metrics if it breaks
+// measurements down by destination.
+func observeTunnel(config *Config, stats ConnStats) {
+	metrics, ok := config.Metrics.(DestinationMetrics)
+	if !ok || stats.Target == "" {
+		return
+	}
+	host, _, err := net.SplitHostPort(stats.Target)
+	if err != nil {
+		host = stats.Target
+	}
+	metrics.ObserveTunnel(metricLabel(config, host), stats.BytesUp, stats.BytesDown, stats.Duration)
+}
+
+// ByteMetrics is an optional interface of Metrics receiving the bytes
+// forwarded by every tunnel while it is open, as deltas since the previous
+// call, for near real-time throughput. The deltas of a tunnel add up to its
+// totals once it is closed.
+type ByteMetrics interface {
+	AddBytes(bytesUp, bytesDown int64)
+}
+
+// byteFlushInterval is how often the bytes forwarded by a tunnel are
+// reported to ByteMetrics.
+const byteFlushInterval = 250 * time.Millisecond
+
+// watchBytes reports the bytes forwarded by sess to config.Metrics every
+// byteFlushInterval if it implements ByteMetrics, until the returned
+// function is called, which reports the rest.
+func watchBytes(sess *session, config *Config) func() {
+	metrics, ok := config.Metrics.(ByteMetrics)
+	if !ok {
+		return func() {}
+	}
+	var lastUp, lastDown int64
+	flush := func() {
+		up, down := sess.meter.BytesUp(), sess.meter.BytesDown()
+		if up != lastUp || down != lastDown {
+			metrics.AddBytes(up-lastUp, down-lastDown)
+			lastUp, lastDown = up, down
+		}
+	}
+
+	ticker := time.NewTicker(byteFlushInterval)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				flush()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		flush()
+	}
+}
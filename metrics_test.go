@@ -0,0 +1,106 @@
+package socks5
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+type tunnelMetrics struct {
+	nopMetrics
+	labels chan string
+}
+
+func (m *tunnelMetrics) ObserveTunnel(label string, bytesUp, bytesDown int64, d time.Duration) {
+	m.labels <- label
+}
+
+func TestMetricLabelFn(t *testing.T) {
+	target := startEchoServer(t)
+	tests := []struct {
+		Name    string
+		LabelFn func(host string) string
+		Label   string
+	}{
+		{"mapped", func(host string) string {
+			if host == "127.0.0.1" {
+				return "loopback"
+			}
+			return host
+		}, "loopback"},
+		{"empty", func(host string) string { return "" }, "other"},
+		{"default", nil, "other"},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			metrics := &tunnelMetrics{labels: make(chan string, 1)}
+			_, proxyAddr := startServer(t, &Config{
+				AuthMethod:    MethodNoAuth,
+				Metrics:       metrics,
+				MetricLabelFn: test.LabelFn,
+			})
+			dialConnect(t, proxyAddr, target).Close()
+			select {
+			case label := <-metrics.labels:
+				if label != test.Label {
+					t.Fatalf("should observe label %q but got %q", test.Label, label)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("should observe the tunnel")
+			}
+		})
+	}
+}
+
+type byteMetrics struct {
+	nopMetrics
+	mu                 sync.Mutex
+	calls              int
+	bytesUp, bytesDown int64
+}
+
+func (m *byteMetrics) AddBytes(bytesUp, bytesDown int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	m.bytesUp += bytesUp
+	m.bytesDown += bytesDown
+}
+
+func (m *byteMetrics) snapshot() (int, int64, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls, m.bytesUp, m.bytesDown
+}
+
+func TestByteMetrics(t *testing.T) {
+	metrics := &byteMetrics{}
+	closed := make(chan ConnStats, 1)
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodNoAuth,
+		Metrics:    metrics,
+		OnClose:    func(stats ConnStats) { closed <- stats },
+	})
+	target := startEchoServer(t)
+	conn := dialConnect(t, proxyAddr, target)
+
+	// Transfer for a few flush intervals
+	buf := make([]byte, 100)
+	for deadline := time.Now().Add(3 * byteFlushInterval); time.Now().Before(deadline); {
+		conn.Write(buf)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("read echo failure: %s", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if calls, _, _ := metrics.snapshot(); calls < 2 {
+		t.Fatalf("should report bytes at least twice before the close but got %d", calls)
+	}
+
+	conn.Close()
+	stats := <-closed
+	if _, up, down := metrics.snapshot(); up != stats.BytesUp || down != stats.BytesDown {
+		t.Fatalf("should report %d bytes up and %d down in total but got %d and %d", stats.BytesUp, stats.BytesDown, up, down)
+	}
+}
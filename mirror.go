@@ -0,0 +1,66 @@
+package socks5
+
+import (
+	"io"
+)
+
+// mirrorQueueSize is the number of writes a mirror may lag behind before
+// further writes are dropped.
+const mirrorQueueSize = 64
+
+// asyncWriter writes to w from a background goroutine. Writes are dropped
+// when its queue is full, so that a slow w never blocks the caller.
+type asyncWriter struct {
+	w     io.Writer
+	queue chan []byte
+	done  chan struct{}
+}
+
+func newAsyncWriter(w io.Writer, size int) *asyncWriter {
+	a := &asyncWriter{
+		w:     w,
+		queue: make(chan []byte, size),
+		done:  make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *asyncWriter) run() {
+	defer close(a.done)
+	for p := range a.queue {
+		a.w.Write(p)
+	}
+}
+
+func (a *asyncWriter) Write(p []byte) (int, error) {
+	select {
+	case a.queue <- append([]byte(nil), p...):
+	default:
+	}
+	return len(p), nil
+}
+
+// Close waits for the queued writes to reach w. It must not be called
+// concurrently with Write.
+func (a *asyncWriter) Close() error {
+	close(a.queue)
+	<-a.done
+	return nil
+}
+
+// newMirrors creates the mirrors of a connection with config.MirrorFactory.
+// The returned writers are nil if the factory is unset or disables them.
+func newMirrors(config *Config, info ConnInfo) (up, down *asyncWriter) {
+	if config.MirrorFactory == nil {
+		return nil, nil
+	}
+	upWriter, downWriter := config.MirrorFactory(info)
+	if upWriter != nil {
+		up = newAsyncWriter(upWriter, mirrorQueueSize)
+	}
+	if downWriter != nil {
+		down = newAsyncWriter(downWriter, mirrorQueueSize)
+	}
+	return up, down
+}
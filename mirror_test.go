@@ -0,0 +1,55 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestMirrorFactory(t *testing.T) {
+	var up, down syncBuffer
+	closed := make(chan struct{})
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodNoAuth,
+		MirrorFactory: func(info ConnInfo) (io.Writer, io.Writer) {
+			return &up, &down
+		},
+		OnClose: func(stats ConnStats) { close(closed) },
+	})
+	conn := dialConnect(t, proxyAddr, startEchoServer(t))
+
+	message := "hello mirror"
+	conn.Write([]byte(message))
+	buf := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read failure: %s", err)
+	}
+	conn.Close()
+	<-closed
+
+	if up.String() != message {
+		t.Fatalf("should mirror %q upstream but got %q", message, up.String())
+	}
+	if down.String() != string(buf) {
+		t.Fatalf("should mirror %q downstream but got %q", buf, down.String())
+	}
+}
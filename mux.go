@@ -0,0 +1,41 @@
+package socks5
+
+import (
+	"context"
+	"log"
+	"net"
+)
+
+// StreamMuxer splits a connection accepted by the server into the streams a
+// client multiplexes over it, accepted from the returned listener. Both
+// *yamux.Session and smux sessions, wrapped to return their streams from
+// Accept, fit: e.g. func(conn net.Conn) (net.Listener, error) { return
+// yamux.Server(conn, nil) }.
+type StreamMuxer func(conn net.Conn) (net.Listener, error)
+
+// serveMux serves every stream of the multiplexed connection conn as a
+// connection of its own, until the client or the server closes it.
+func (s *SOCKS5Server) serveMux(conn net.Conn, muxer StreamMuxer) {
+	streams, err := muxer(conn)
+	if err != nil {
+		log.Printf("stream muxer failure from %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	defer streams.Close()
+	if !s.trackListener(streams) {
+		return
+	}
+	defer s.untrackListener(streams)
+
+	for {
+		stream, err := streams.Accept()
+		if err != nil {
+			if !s.isDraining() {
+				log.Printf("accept stream failure from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		go s.ServeConn(context.Background(), stream)
+	}
+}
@@ -0,0 +1,216 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMux multiplexes streams over a connection with frames made of a
+// stream ID, a length and data. An empty frame closes the stream. Streams
+// are opened by sending data on a new ID.
+type testMux struct {
+	conn net.Conn
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	streams map[uint32]*testStream
+	nextID  uint32
+	accept  chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newTestMux(conn net.Conn) *testMux {
+	m := &testMux{
+		conn:    conn,
+		streams: make(map[uint32]*testStream),
+		accept:  make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	go m.demux()
+	return m
+}
+
+func (m *testMux) demux() {
+	defer m.Close()
+	header := make([]byte, 6)
+	for {
+		if _, err := io.ReadFull(m.conn, header); err != nil {
+			return
+		}
+		id, length := binary.BigEndian.Uint32(header), binary.BigEndian.Uint16(header[4:])
+		data := make([]byte, length)
+		if _, err := io.ReadFull(m.conn, data); err != nil {
+			return
+		}
+
+		m.mu.Lock()
+		stream, ok := m.streams[id]
+		if !ok {
+			stream = m.newStream(id)
+		}
+		m.mu.Unlock()
+		if !ok {
+			select {
+			case m.accept <- stream:
+			case <-m.done:
+				return
+			}
+		}
+		if length == 0 {
+			stream.pw.Close()
+			continue
+		}
+		stream.pw.Write(data)
+	}
+}
+
+// newStream registers the stream id. m.mu must be held.
+func (m *testMux) newStream(id uint32) *testStream {
+	pr, pw := io.Pipe()
+	stream := &testStream{mux: m, id: id, pr: pr, pw: pw}
+	m.streams[id] = stream
+	return stream
+}
+
+// open opens a new stream.
+func (m *testMux) open() *testStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	return m.newStream(m.nextID)
+}
+
+func (m *testMux) writeFrame(id uint32, data []byte) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	frame := make([]byte, 6, 6+len(data))
+	binary.BigEndian.PutUint32(frame, id)
+	binary.BigEndian.PutUint16(frame[4:], uint16(len(data)))
+	_, err := m.conn.Write(append(frame, data...))
+	return err
+}
+
+func (m *testMux) Accept() (net.Conn, error) {
+	select {
+	case stream := <-m.accept:
+		return stream, nil
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *testMux) Close() error {
+	m.once.Do(func() {
+		close(m.done)
+		m.conn.Close()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for _, stream := range m.streams {
+			stream.pw.Close()
+		}
+	})
+	return nil
+}
+
+func (m *testMux) Addr() net.Addr {
+	return m.conn.LocalAddr()
+}
+
+type testStream struct {
+	mux *testMux
+	id  uint32
+	pr  *io.PipeReader
+	pw  *io.PipeWriter
+}
+
+func (s *testStream) Read(b []byte) (int, error) {
+	return s.pr.Read(b)
+}
+
+func (s *testStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > 1<<16-1 {
+			n = 1<<16 - 1
+		}
+		if err := s.mux.writeFrame(s.id, b[:n]); err != nil {
+			return written, err
+		}
+		written, b = written+n, b[n:]
+	}
+	return written, nil
+}
+
+func (s *testStream) Close() error {
+	s.pr.Close()
+	return s.mux.writeFrame(s.id, nil)
+}
+
+func (s *testStream) LocalAddr() net.Addr                { return s.mux.conn.LocalAddr() }
+func (s *testStream) RemoteAddr() net.Addr               { return s.mux.conn.RemoteAddr() }
+func (s *testStream) SetDeadline(t time.Time) error      { return nil }
+func (s *testStream) SetReadDeadline(t time.Time) error  { return nil }
+func (s *testStream) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestStreamMuxer(t *testing.T) {
+	server, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodNoAuth,
+		StreamMuxer: func(conn net.Conn) (net.Listener, error) {
+			return newTestMux(conn), nil
+		},
+	})
+	target := startEchoServer(t)
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := net.LookupPort("tcp", port)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy failure: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	mux := newTestMux(conn)
+	defer mux.Close()
+
+	const streams = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, streams)
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream := mux.open()
+			defer stream.Close()
+			WriteClientAuthMessage(stream, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+			if _, err := ReadServerAuthMessage(stream); err != nil {
+				errs <- fmt.Errorf("read auth reply failure: %w", err)
+				return
+			}
+			WriteClientRequestMessage(stream, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeIPv4, Address: host, Port: uint16(portNum)})
+			if reply, err := ReadServerReplyMessage(stream); err != nil || reply.Reply != ReplySuccess {
+				errs <- fmt.Errorf("should get reply success but got %v, %v", reply, err)
+				return
+			}
+			message := fmt.Sprintf("stream %d", i)
+			stream.Write([]byte(message))
+			buf := make([]byte, len(message))
+			if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != message {
+				errs <- fmt.Errorf("should get %q but got %q, %v", message, buf, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if total := server.Stats().TotalConnections; total != streams {
+		t.Fatalf("should serve %d connections but got %d", streams, total)
+	}
+}
@@ -0,0 +1,66 @@
+package socks5
+
+import (
+	"bufio"
+	"errors"
+	"net"
+)
+
+var ErrProtocolNotSupported = errors.New("protocol not supported")
+
+// Protocol is the protocol spoken by a client, detected from its first byte.
+type Protocol int
+
+const (
+	ProtocolUnknown Protocol = iota
+	ProtocolSOCKS5
+	ProtocolSOCKS4
+	ProtocolHTTP
+	ProtocolTLS
+)
+
+// detectProtocol guesses the protocol of a connection from its first byte.
+func detectProtocol(first byte) Protocol {
+	switch {
+	case first == SOCKS5Version:
+		return ProtocolSOCKS5
+	case first == 0x04:
+		return ProtocolSOCKS4
+	case first == tlsRecordTypeHandshake:
+		return ProtocolTLS
+	case first >= 'A' && first <= 'Z':
+		// HTTP methods are upper case tokens such as CONNECT or GET
+		return ProtocolHTTP
+	}
+	return ProtocolUnknown
+}
+
+// peekConn is a net.Conn whose first bytes can be inspected without being
+// consumed. Everything read from it, peeked or not, goes through the same
+// buffer, so it must be used for all reads once created.
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newPeekConn(conn net.Conn) *peekConn {
+	return &peekConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+// Peek returns the next n bytes without advancing the reader.
+func (c *peekConn) Peek(n int) ([]byte, error) {
+	return c.r.Peek(n)
+}
+
+func (c *peekConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite closes the write side of the underlying connection if it
+// supports half-close.
+func (c *peekConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("half-close not supported")
+}
@@ -0,0 +1,65 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestProtocolDispatch(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Data     []byte
+		Protocol Protocol
+	}{
+		{"SOCKS4", []byte{0x04, CmdConnect, 0x00, 0x50, 10, 0, 0, 1, 0x00}, ProtocolSOCKS4},
+		{"HTTP", []byte("CONNECT example.com:443 HTTP/1.1\r\n\r\n"), ProtocolHTTP},
+		{"TLS", []byte{tlsRecordTypeHandshake, 0x03, 0x01, 0x00, 0x00}, ProtocolTLS},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			received := make(chan []byte, 1)
+			handler := func(conn net.Conn) error {
+				buf := make([]byte, len(test.Data))
+				_, err := io.ReadFull(conn, buf)
+				received <- buf
+				return err
+			}
+			config := Config{
+				AuthMethod:       MethodNoAuth,
+				ProtocolHandlers: map[Protocol]func(net.Conn) error{test.Protocol: handler},
+			}
+
+			client, server := net.Pipe()
+			defer client.Close()
+			go client.Write(test.Data)
+			if err := handleConnection(&session{conn: server}, &config); err != nil {
+				t.Fatalf("should get error nil but got %s", err)
+			}
+			if got := <-received; !bytes.Equal(got, test.Data) {
+				t.Fatalf("handler should read %v but got %v", test.Data, got)
+			}
+		})
+	}
+
+	t.Run("SOCKS5", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go handleConnection(&session{conn: server}, &Config{AuthMethod: MethodNoAuth})
+		WriteClientAuthMessage(client, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+		if method, err := ReadServerAuthMessage(client); err != nil || method != MethodNoAuth {
+			t.Fatalf("should negotiate method %d but got %d, %v", MethodNoAuth, method, err)
+		}
+	})
+
+	t.Run("no handler", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		err := handleConnection(&session{conn: server}, &Config{AuthMethod: MethodNoAuth})
+		if err != ErrProtocolNotSupported {
+			t.Fatalf("should get error %s but got %v", ErrProtocolNotSupported, err)
+		}
+	})
+}
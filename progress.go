@@ -0,0 +1,42 @@
+package socks5
+
+import (
+	"log"
+	"time"
+)
+
+// watchProgress reports the bytes forwarded by sess every
+// config.ProgressInterval once they exceed config.ProgressThreshold, until
+// the returned function is called.
+func watchProgress(sess *session, config *Config) func() {
+	if config.ProgressInterval <= 0 {
+		return func() {}
+	}
+	ticker := time.NewTicker(config.ProgressInterval)
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		var lastUp, lastDown int64
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			up, down := sess.meter.BytesUp(), sess.meter.BytesDown()
+			if up+down <= config.ProgressThreshold {
+				continue
+			}
+			info := sess.snapshot()
+			if config.OnProgress != nil {
+				config.OnProgress(info, up, down)
+			} else {
+				seconds := config.ProgressInterval.Seconds()
+				log.Printf("connection %s to %s: %d bytes up, %d down (%.0f B/s up, %.0f B/s down)",
+					info.ID, info.Target, up, down, float64(up-lastUp)/seconds, float64(down-lastDown)/seconds)
+			}
+			lastUp, lastDown = up, down
+		}
+	}()
+	return func() { close(done) }
+}
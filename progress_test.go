@@ -0,0 +1,48 @@
+package socks5
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestProgressInterval(t *testing.T) {
+	type progress struct {
+		info     ConnInfo
+		up, down int64
+	}
+	events := make(chan progress, 16)
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod:        MethodNoAuth,
+		ProgressInterval:  10 * time.Millisecond,
+		ProgressThreshold: 4,
+		OnProgress: func(info ConnInfo, up, down int64) {
+			select {
+			case events <- progress{info, up, down}:
+			default:
+			}
+		},
+	})
+	target := startEchoServer(t)
+	conn := dialConnect(t, proxyAddr, target)
+
+	// Below the threshold nothing is reported
+	conn.Write([]byte("ab"))
+	io.ReadFull(conn, make([]byte, 2))
+	select {
+	case event := <-events:
+		t.Fatalf("should not report progress below the threshold but got %v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	conn.Write([]byte("cdef"))
+	io.ReadFull(conn, make([]byte, 4))
+	select {
+	case event := <-events:
+		if event.info.Target != target || event.up != 6 || event.down != 6 {
+			t.Fatalf("should report 6 bytes each way to %s but got %v", target, event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("should report progress")
+	}
+}
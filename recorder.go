@@ -0,0 +1,81 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+)
+
+var (
+	ErrRecorderFull   = errors.New("recorder buffer full")
+	ErrRecorderClosed = errors.New("recorder closed")
+)
+
+// ConnRecorder persists the statistics of finished connections, e.g. into a
+// database or a file.
+type ConnRecorder interface {
+	Record(ctx context.Context, stats ConnStats) error
+}
+
+// BufferedRecorder queues records and hands them to another ConnRecorder
+// from a background goroutine, so that a slow sink never holds up a
+// connection. Records are dropped with ErrRecorderFull when the queue is
+// full.
+type BufferedRecorder struct {
+	next  ConnRecorder
+	queue chan ConnStats
+	done  chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewBufferedRecorder returns a BufferedRecorder queueing up to size records
+// for next.
+func NewBufferedRecorder(next ConnRecorder, size int) *BufferedRecorder {
+	r := &BufferedRecorder{
+		next:  next,
+		queue: make(chan ConnStats, size),
+		done:  make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+func (r *BufferedRecorder) run() {
+	defer close(r.done)
+	for stats := range r.queue {
+		if err := r.next.Record(context.Background(), stats); err != nil {
+			log.Printf("record connection %s failure: %s", stats.ID, err)
+		}
+	}
+}
+
+// Record queues stats without blocking.
+func (r *BufferedRecorder) Record(ctx context.Context, stats ConnStats) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return ErrRecorderClosed
+	}
+	select {
+	case r.queue <- stats:
+		return nil
+	default:
+		return ErrRecorderFull
+	}
+}
+
+// Close flushes the queued records to the underlying recorder and stops the
+// background goroutine.
+func (r *BufferedRecorder) Close() error {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+	<-r.done
+	return nil
+}
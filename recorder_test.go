@@ -0,0 +1,52 @@
+package socks5
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+type memoryRecorder struct {
+	mu      sync.Mutex
+	records []ConnStats
+}
+
+func (r *memoryRecorder) Record(ctx context.Context, stats ConnStats) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, stats)
+	return nil
+}
+
+func TestBufferedRecorder(t *testing.T) {
+	memory := &memoryRecorder{}
+	recorder := NewBufferedRecorder(memory, 16)
+
+	closed := make(chan struct{}, 3)
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodNoAuth,
+		Recorder:   recorder,
+		OnClose:    func(stats ConnStats) { closed <- struct{}{} },
+	})
+	target := startEchoServer(t)
+	for i := 0; i < 3; i++ {
+		conn := dialConnect(t, proxyAddr, target)
+		conn.Close()
+		<-closed
+	}
+
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if len(memory.records) != 3 {
+		t.Fatalf("should flush 3 records but got %d", len(memory.records))
+	}
+	for _, stats := range memory.records {
+		if stats.Target != target {
+			t.Fatalf("should record target %s but got %s", target, stats.Target)
+		}
+	}
+	if err := recorder.Record(context.Background(), ConnStats{}); err != ErrRecorderClosed {
+		t.Fatalf("should get error %s but got %v", ErrRecorderClosed, err)
+	}
+}
@@ -1,8 +1,12 @@
 package socks5
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"strings"
 )
 
 const (
@@ -48,6 +52,51 @@ const (
 	ReplyAddressTypeNotSupported
 )
 
+// Request is a client request being handled by the server.
+type Request struct {
+	ClientRequestMessage
+	ConnInfo ConnInfo
+
+	// IPs are the addresses the target resolves to, in the order they are
+	// dialed. It holds the address itself for IPv4 and IPv6 targets, and is
+	// empty for domain targets left to an upstream proxy to resolve.
+	IPs []net.IP
+
+	ctx context.Context
+}
+
+// Context returns the context of the connection the request was made on,
+// see Config.OnConnect.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// RejectError rejects a request with a specific reply code. Hooks return it
+// to control what the client sees.
+type RejectError struct {
+	Reply  ReplyType
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("request rejected with reply %d", e.Reply)
+	}
+	return "request rejected: " + e.Reason
+}
+
+// rejectReply returns the reply code for a request rejected with err.
+func rejectReply(err error) ReplyType {
+	var rejectErr *RejectError
+	if errors.As(err, &rejectErr) {
+		return rejectErr.Reply
+	}
+	return ReplyConnectionNotAllowed
+}
+
 func NewClientRequestMessage(conn io.Reader) (*ClientRequestMessage, error) {
 	// Read version, command, reserved, address type
 	buf := make([]byte, 4)
@@ -71,68 +120,191 @@ func NewClientRequestMessage(conn io.Reader) (*ClientRequestMessage, error) {
 	}
 
 	// Read address and port
-	message := ClientRequestMessage{
+	address, port, err := readAddress(conn, addrType)
+	if err != nil {
+		return nil, err
+	}
+	if addrType == TypeDomain && !validDomain(address) {
+		return nil, ErrInvalidDomain
+	}
+	return &ClientRequestMessage{
 		Cmd:      command,
 		AddrType: addrType,
+		Address:  address,
+		Port:     port,
+	}, nil
+}
+
+// validDomain reports whether domain is plausible as a hostname: not empty,
+// without empty labels or labels over 63 bytes, and without spaces or
+// control characters.
+func validDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	for i := 0; i < len(domain); i++ {
+		if c := domain[i]; c <= ' ' || c == 0x7f {
+			return false
+		}
 	}
+	return true
+}
+
+// readAddress reads an address of type addrType followed by a port number.
+func readAddress(conn io.Reader, addrType AddressType) (string, uint16, error) {
+	var address string
+	buf := make([]byte, IPv4Length)
 	switch addrType {
 	case TypeIPv6:
 		buf = make([]byte, IPv6Length)
 		fallthrough
 	case TypeIPv4:
 		if _, err := io.ReadFull(conn, buf); err != nil {
-			return nil, err
+			return "", 0, err
 		}
 		ip := net.IP(buf)
-		message.Address = ip.String()
+		address = ip.String()
 	case TypeDomain:
 		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
-			return nil, err
+			return "", 0, err
 		}
 		domainLength := buf[0]
 		if domainLength > IPv4Length {
 			buf = make([]byte, domainLength)
 		}
 		if _, err := io.ReadFull(conn, buf[:domainLength]); err != nil {
-			return nil, err
+			return "", 0, err
 		}
-		message.Address = string(buf[:domainLength])
+		address = string(buf[:domainLength])
+	default:
+		return "", 0, ErrAddressTypeNotSupported
 	}
 
 	// Read port number
 	if _, err := io.ReadFull(conn, buf[:PortLength]); err != nil {
+		return "", 0, err
+	}
+	return address, (uint16(buf[0]) << 8) + uint16(buf[1]), nil
+}
+
+// appendAddress appends address of type addrType and port to buf.
+func appendAddress(buf []byte, addrType AddressType, address string, port uint16) ([]byte, error) {
+	switch addrType {
+	case TypeIPv4:
+		ip := net.ParseIP(address).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address: %q", address)
+		}
+		buf = append(buf, ip...)
+	case TypeIPv6:
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv6 address: %q", address)
+		}
+		buf = append(buf, ip.To16()...)
+	case TypeDomain:
+		if len(address) > 255 {
+			return nil, fmt.Errorf("domain too long: %q", address)
+		}
+		buf = append(buf, byte(len(address)))
+		buf = append(buf, address...)
+	default:
+		return nil, ErrAddressTypeNotSupported
+	}
+	return append(buf, byte(port>>8), byte(port)), nil
+}
+
+// WriteClientRequestMessage writes message as sent by a client.
+func WriteClientRequestMessage(conn io.Writer, message *ClientRequestMessage) error {
+	buf, err := appendAddress([]byte{SOCKS5Version, message.Cmd, ReservedField, message.AddrType},
+		message.AddrType, message.Address, message.Port)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(buf)
+	return err
+}
+
+// ServerReplyMessage is the reply of the server to a ClientRequestMessage.
+type ServerReplyMessage struct {
+	Reply    ReplyType
+	AddrType AddressType
+	Address  string
+	Port     uint16
+}
+
+// ReadServerReplyMessage reads the reply of the server to a request.
+func ReadServerReplyMessage(conn io.Reader) (*ServerReplyMessage, error) {
+	// Read version, reply, reserved, address type
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
 		return nil, err
 	}
-	message.Port = (uint16(buf[0]) << 8) + uint16(buf[1])
+	version, reply, reserved, addrType := buf[0], buf[1], buf[2], buf[3]
+	if version != SOCKS5Version {
+		return nil, ErrVersionNotSupported
+	}
+	if reserved != ReservedField {
+		return nil, ErrInvalidReservedField
+	}
 
-	return &message, nil
+	address, port, err := readAddress(conn, addrType)
+	if err != nil {
+		return nil, err
+	}
+	return &ServerReplyMessage{
+		Reply:    reply,
+		AddrType: addrType,
+		Address:  address,
+		Port:     port,
+	}, nil
 }
 
 func WriteRequestSuccessMessage(conn io.Writer, ip net.IP, port uint16) error {
 	addressType := TypeIPv4
-	if len(ip) == IPv6Length {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else if len(ip) == IPv6Length {
 		addressType = TypeIPv6
+	} else {
+		ip = net.IPv4zero.To4()
 	}
 
-	// Write version, reply success, reserved, address type
-	_, err := conn.Write([]byte{SOCKS5Version, ReplySuccess, ReservedField, addressType})
-	if err != nil {
-		return err
-	}
+	// Write version, reply success, reserved, address type, bind IP
+	// (IPv4/IPv6) and bind port at once, as every reply is written
+	buf := []byte{SOCKS5Version, ReplySuccess, ReservedField, addressType}
+	buf = append(buf, ip...)
+	buf = append(buf, byte(port>>8), byte(port))
+	_, err := conn.Write(buf)
+	return err
+}
 
-	// Write bind IP(IPv4/IPv6)
-	if _, err := conn.Write(ip); err != nil {
+// WriteRequestSuccessHostMessage writes a success reply whose bound address
+// is the hostname host, for clients to resolve themselves.
+func WriteRequestSuccessHostMessage(conn io.Writer, host string, port uint16) error {
+	buf, err := appendAddress([]byte{SOCKS5Version, ReplySuccess, ReservedField, TypeDomain}, TypeDomain, host, port)
+	if err != nil {
 		return err
 	}
-
-	// Write bind port
-	buf := make([]byte, 2)
-	buf[0] = byte(port >> 8)
-	buf[1] = byte(port - uint16(buf[0])<<8)
 	_, err = conn.Write(buf)
 	return err
 }
 
+// writeBoundAddress writes a success reply with the bound address ip and
+// port, or with config.ReplyBindHost instead of ip when set.
+func writeBoundAddress(conn io.Writer, config *Config, ip net.IP, port uint16) error {
+	if config.ReplyBindHost != "" {
+		return WriteRequestSuccessHostMessage(conn, config.ReplyBindHost, port)
+	}
+	return WriteRequestSuccessMessage(conn, ip, port)
+}
+
 func WriteRequestFailureMessage(conn io.Writer, replyType ReplyType) error {
 	_, err := conn.Write([]byte{SOCKS5Version, replyType, ReservedField, TypeIPv4, 0, 0, 0, 0, 0, 0})
 	return err
@@ -2,7 +2,13 @@ package socks5
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strconv"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestNewClientRequestMessage(t *testing.T) {
@@ -64,3 +70,187 @@ func TestNewClientRequestMessage(t *testing.T) {
 		}
 	}
 }
+
+func TestRequestMessageOneByteAtATime(t *testing.T) {
+	messages := []ClientRequestMessage{
+		{Cmd: CmdConnect, AddrType: TypeIPv4, Address: "123.35.13.89", Port: 80},
+		{Cmd: CmdConnect, AddrType: TypeIPv6, Address: "fd00::1", Port: 443},
+		{Cmd: CmdConnect, AddrType: TypeDomain, Address: "example.com", Port: 8080},
+	}
+	for _, want := range messages {
+		var buf bytes.Buffer
+		WriteClientRequestMessage(&buf, &want)
+		message, err := NewClientRequestMessage(iotest.OneByteReader(&buf))
+		if err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+		if *message != want {
+			t.Fatalf("should get message %v but got %v", want, *message)
+		}
+	}
+}
+
+// TestHandshakeSegmented sends every byte of the handshake in a segment of
+// its own.
+func TestHandshakeSegmented(t *testing.T) {
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod:      MethodPassword,
+		PasswordChecker: func(username, password string) bool { return username == "admin" && password == "123456" },
+	})
+	target := startEchoServer(t)
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy failure: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	var buf bytes.Buffer
+	WriteClientAuthMessage(&buf, &ClientAuthMessage{Methods: []Method{MethodPassword}})
+	WriteClientPasswordMessage(&buf, &ClientPasswordMessage{Username: "admin", Password: "123456"})
+	WriteClientRequestMessage(&buf, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeIPv4, Address: host, Port: uint16(portNum)})
+	for _, b := range buf.Bytes() {
+		if _, err := conn.Write([]byte{b}); err != nil {
+			t.Fatalf("write failure: %s", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if method, err := ReadServerAuthMessage(conn); err != nil || method != MethodPassword {
+		t.Fatalf("should get method %d but got %d, %v", MethodPassword, method, err)
+	}
+	if status, err := ReadServerPasswordMessage(conn); err != nil || status != PasswordAuthSuccess {
+		t.Fatalf("should get password status success but got %d, %v", status, err)
+	}
+	if reply, err := ReadServerReplyMessage(conn); err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should get reply success but got %v, %v", reply, err)
+	}
+}
+
+func TestRequestMessageRoundTrip(t *testing.T) {
+	messages := []ClientRequestMessage{
+		{Cmd: CmdConnect, AddrType: TypeIPv4, Address: "123.35.13.89", Port: 80},
+		{Cmd: CmdBind, AddrType: TypeIPv6, Address: "fd00::1", Port: 443},
+		{Cmd: CmdUDP, AddrType: TypeDomain, Address: "example.com", Port: 53},
+	}
+	for _, want := range messages {
+		var buf bytes.Buffer
+		if err := WriteClientRequestMessage(&buf, &want); err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+		message, err := NewClientRequestMessage(&buf)
+		if err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+		if *message != want {
+			t.Fatalf("should get message %v but got %v", want, *message)
+		}
+	}
+}
+
+func TestReplyMessageRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteRequestSuccessMessage(&buf, net.ParseIP("fd00::1"), 1080); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	reply, err := ReadServerReplyMessage(&buf)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	want := ServerReplyMessage{Reply: ReplySuccess, AddrType: TypeIPv6, Address: "fd00::1", Port: 1080}
+	if *reply != want {
+		t.Fatalf("should get reply %v but got %v", want, *reply)
+	}
+
+	if err := WriteRequestFailureMessage(&buf, ReplyHostUnreachable); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if reply, err := ReadServerReplyMessage(&buf); err != nil || reply.Reply != ReplyHostUnreachable {
+		t.Fatalf("should get reply %d but got %v, %v", ReplyHostUnreachable, reply, err)
+	}
+}
+
+func TestRequestLinkLocalTarget(t *testing.T) {
+	tests := []struct {
+		Name      string
+		Interface string
+		Address   string
+		Err       error
+	}{
+		{"egress interface", "eth0", "[fe80::1%eth0]:80", nil},
+		{"no egress interface", "", "", ErrLinkLocalZoneRequired},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var dialed string
+			config := Config{
+				AuthMethod:      MethodNoAuth,
+				EgressInterface: test.Interface,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					dialed = address
+					return nil, errors.New("unreachable")
+				},
+			}
+			var buf bytes.Buffer
+			WriteClientRequestMessage(&buf, &ClientRequestMessage{
+				Cmd:      CmdConnect,
+				AddrType: TypeIPv6,
+				Address:  "fe80::1",
+				Port:     80,
+			})
+
+			_, _, err := request(context.Background(), &buf, &config, ConnInfo{})
+			if test.Err != nil && err != test.Err {
+				t.Fatalf("should get error %s but got %v", test.Err, err)
+			}
+			if dialed != test.Address {
+				t.Fatalf("should dial %q but got %q", test.Address, dialed)
+			}
+		})
+	}
+
+	t.Run("UDP relay", func(t *testing.T) {
+		if zone, err := targetZone(net.ParseIP("fe80::1"), &Config{EgressInterface: "eth0"}); err != nil || zone != "eth0" {
+			t.Fatalf("should get zone eth0 but got %q, %v", zone, err)
+		}
+		if zone, err := targetZone(net.ParseIP("2001:db8::1"), &Config{}); err != nil || zone != "" {
+			t.Fatalf("should get no zone for a global address but got %q, %v", zone, err)
+		}
+	})
+}
+
+func TestInvalidDomain(t *testing.T) {
+	config := Config{
+		AuthMethod: MethodNoAuth,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			t.Fatalf("should not dial %q", address)
+			return nil, nil
+		},
+	}
+	if err := initConfig(&config); err != nil {
+		t.Fatalf("init config failure: %s", err)
+	}
+	for _, domain := range []string{"", ".", "a..example.com", "ex ample.com", "example.com\x00", string(bytes.Repeat([]byte{'a'}, 64)) + ".com"} {
+		var buf bytes.Buffer
+		buf.Write([]byte{SOCKS5Version, CmdConnect, ReservedField, TypeDomain, byte(len(domain))})
+		buf.WriteString(domain)
+		buf.Write([]byte{0x00, 0x50})
+
+		_, _, err := request(context.Background(), &buf, &config, ConnInfo{})
+		if err != ErrInvalidDomain {
+			t.Fatalf("domain %q: should get error %s but got %v", domain, ErrInvalidDomain, err)
+		}
+		if reply, err := ReadServerReplyMessage(&buf); err != nil || reply.Reply != ReplyServerFailure {
+			t.Fatalf("domain %q: should get reply %d but got %v, %v", domain, ReplyServerFailure, reply, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	WriteClientRequestMessage(&buf, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeDomain, Address: "example.com.", Port: 80})
+	if _, err := NewClientRequestMessage(&buf); err != nil {
+		t.Fatalf("should accept a fully qualified domain but got %s", err)
+	}
+}
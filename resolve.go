@@ -0,0 +1,212 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Resolver resolves the domain names of targets. *net.Resolver implements
+// it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// AddressPreference decides which address family is dialed first when a
+// domain resolves to both IPv4 and IPv6 addresses.
+type AddressPreference int
+
+const (
+	// PreferSystem keeps the order returned by the resolver.
+	PreferSystem AddressPreference = iota
+	PreferIPv4
+	PreferIPv6
+)
+
+// requestHost rewrites the domain of a request with config.NormalizeHost,
+// or normalizes it as destination rules are.
+func requestHost(config *Config, host string) string {
+	if config.NormalizeHost != nil {
+		return config.NormalizeHost(host)
+	}
+	return normalizeHost(host)
+}
+
+// lookupIPs resolves host with config.Resolver within config.ResolveTimeout
+// and returns the addresses usable on config.TargetNetwork, ordered by
+// config.AddressPreference. ctx is the one of the connection.
+func lookupIPs(ctx context.Context, host string, config *Config) ([]net.IP, error) {
+	addrs, err := resolve(ctx, host, config)
+	if err != nil {
+		return nil, err
+	}
+	var usable []net.IP
+	for _, addr := range addrs {
+		ip := addr.IP
+		isIPv4 := ip.To4() != nil
+		if (config.TargetNetwork == "tcp4" && !isIPv4) || (config.TargetNetwork == "tcp6" && isIPv4) {
+			continue
+		}
+		usable = append(usable, ip)
+	}
+	if len(usable) == 0 {
+		return nil, fmt.Errorf("IP地址解析失败:%s", host)
+	}
+	return orderIPs(usable, config.AddressPreference), nil
+}
+
+// resolve returns the addresses of host from the DNS cache, or from
+// config.Resolver within config.ResolveTimeout. The lookup is aborted once
+// ctx is done, e.g. when the connection is closed.
+func resolve(ctx context.Context, host string, config *Config) ([]net.IPAddr, error) {
+	metrics := metricsOf(config)
+	if config.dnsCache != nil {
+		if addrs, ok := config.dnsCache.get(host); ok {
+			metrics.IncDNSCacheHit()
+			return addrs, nil
+		}
+		metrics.IncDNSCacheMiss()
+	}
+
+	var resolver Resolver = net.DefaultResolver
+	if config.Resolver != nil {
+		resolver = config.Resolver
+	} else if config.DoHEndpoint != "" {
+		resolver = &DoHResolver{Endpoint: config.DoHEndpoint}
+	}
+	if config.ResolveTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.ResolveTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	metrics.ObserveResolveLatency(time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	if config.dnsCache != nil {
+		config.dnsCache.put(host, addrs)
+	}
+	return addrs, nil
+}
+
+// dnsCache holds resolved addresses until they expire.
+type dnsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+func newDNSCache(config *Config) *dnsCache {
+	if config.DNSCacheTTL <= 0 {
+		return nil
+	}
+	size := config.DNSCacheSize
+	if size <= 0 {
+		size = 1024
+	}
+	return &dnsCache{ttl: config.DNSCacheTTL, size: size, entries: make(map[string]dnsCacheEntry)}
+}
+
+func (c *dnsCache) get(host string) ([]net.IPAddr, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[host]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.addrs, true
+}
+
+// put caches addrs for host. When the cache is full, expired entries are
+// dropped first and an arbitrary one if none has expired.
+func (c *dnsCache) put(host string, addrs []net.IPAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if _, ok := c.entries[host]; !ok && len(c.entries) >= c.size {
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		for key := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, key)
+		}
+	}
+	c.entries[host] = dnsCacheEntry{addrs: addrs, expires: now.Add(c.ttl)}
+}
+
+// orderIPs moves the addresses of the preferred family to the front, keeping
+// the relative order within each family.
+func orderIPs(ips []net.IP, preference AddressPreference) []net.IP {
+	if preference == PreferSystem {
+		return ips
+	}
+	preferIPv4 := preference == PreferIPv4
+	ordered := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if (ip.To4() != nil) == preferIPv4 {
+			ordered = append(ordered, ip)
+		}
+	}
+	for _, ip := range ips {
+		if (ip.To4() != nil) != preferIPv4 {
+			ordered = append(ordered, ip)
+		}
+	}
+	return ordered
+}
+
+// logResolution logs the resolution of host to ips for Config.LogResolution,
+// with the address connected to or the error of the request.
+func logResolution(host string, ips []net.IP, elapsed time.Duration, chosen net.Addr, err error) {
+	resolved := make([]string, len(ips))
+	for i, ip := range ips {
+		resolved[i] = ip.String()
+	}
+	if err != nil {
+		log.Printf("resolution of %s: [%s] in %v, failed: %s", host, strings.Join(resolved, " "), elapsed, err)
+		return
+	}
+	log.Printf("resolution of %s: [%s] in %v, connected to %v", host, strings.Join(resolved, " "), elapsed, chosen)
+}
+
+// targetBalancer rotates the addresses of domain targets for
+// Config.BalanceTargets.
+type targetBalancer struct {
+	next uint32
+}
+
+func newTargetBalancer(config *Config) *targetBalancer {
+	if !config.BalanceTargets {
+		return nil
+	}
+	return &targetBalancer{}
+}
+
+// rotate returns addresses starting from the next one in turn.
+func (b *targetBalancer) rotate(addresses []string) []string {
+	if b == nil || len(addresses) < 2 {
+		return addresses
+	}
+	i := int((atomic.AddUint32(&b.next, 1) - 1) % uint32(len(addresses)))
+	rotated := make([]string, 0, len(addresses))
+	rotated = append(rotated, addresses[i:]...)
+	return append(rotated, addresses[:i]...)
+}
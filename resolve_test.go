@@ -0,0 +1,419 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOrderIPs(t *testing.T) {
+	v4a, v4b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	v6a, v6b := net.ParseIP("fd00::1"), net.ParseIP("fd00::2")
+	ips := []net.IP{v6a, v4a, v6b, v4b}
+
+	tests := []struct {
+		Preference AddressPreference
+		Want       []net.IP
+	}{
+		{PreferSystem, []net.IP{v6a, v4a, v6b, v4b}},
+		{PreferIPv4, []net.IP{v4a, v4b, v6a, v6b}},
+		{PreferIPv6, []net.IP{v6a, v6b, v4a, v4b}},
+	}
+	for _, test := range tests {
+		got := orderIPs(ips, test.Preference)
+		if !reflect.DeepEqual(got, test.Want) {
+			t.Fatalf("preference %d: should get order %v but got %v", test.Preference, test.Want, got)
+		}
+	}
+}
+
+// listResolver answers every lookup with its addresses, in order.
+type listResolver []net.IP
+
+func (r listResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs := make([]net.IPAddr, len(r))
+	for i, ip := range r {
+		addrs[i] = net.IPAddr{IP: ip}
+	}
+	return addrs, nil
+}
+
+func TestAddressPreferenceDialOrder(t *testing.T) {
+	resolver := listResolver{net.ParseIP("fd00::1"), net.ParseIP("10.0.0.1"), net.ParseIP("fd00::2"), net.ParseIP("10.0.0.2")}
+	tests := []struct {
+		Preference AddressPreference
+		Want       []string
+	}{
+		{PreferSystem, []string{"[fd00::1]:80", "10.0.0.1:80", "[fd00::2]:80", "10.0.0.2:80"}},
+		{PreferIPv4, []string{"10.0.0.1:80", "10.0.0.2:80", "[fd00::1]:80", "[fd00::2]:80"}},
+		{PreferIPv6, []string{"[fd00::1]:80", "[fd00::2]:80", "10.0.0.1:80", "10.0.0.2:80"}},
+	}
+	for _, test := range tests {
+		var dialed []string
+		config := Config{
+			AuthMethod:        MethodNoAuth,
+			Resolver:          resolver,
+			AddressPreference: test.Preference,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				dialed = append(dialed, address)
+				return nil, errors.New("unreachable")
+			},
+		}
+		if err := initConfig(&config); err != nil {
+			t.Fatalf("init config failure: %s", err)
+		}
+		var buf bytes.Buffer
+		WriteClientRequestMessage(&buf, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeDomain, Address: "dual.test", Port: 80})
+		if _, _, err := request(context.Background(), &buf, &config, ConnInfo{}); err == nil {
+			t.Fatalf("preference %d: should fail to connect", test.Preference)
+		}
+		if !reflect.DeepEqual(dialed, test.Want) {
+			t.Fatalf("preference %d: should dial %v but got %v", test.Preference, test.Want, dialed)
+		}
+	}
+}
+
+// blockingResolver never answers before its context is done. It then
+// sends the context on looked, if set.
+type blockingResolver struct {
+	looked chan context.Context
+}
+
+func (r blockingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	<-ctx.Done()
+	if r.looked != nil {
+		r.looked <- ctx
+	}
+	return nil, ctx.Err()
+}
+
+func TestResolveTimeout(t *testing.T) {
+	config := Config{
+		AuthMethod:     MethodNoAuth,
+		Resolver:       blockingResolver{},
+		ResolveTimeout: 50 * time.Millisecond,
+	}
+	var buf bytes.Buffer
+	WriteClientRequestMessage(&buf, &ClientRequestMessage{
+		Cmd:      CmdConnect,
+		AddrType: TypeDomain,
+		Address:  "example.com",
+		Port:     80,
+	})
+
+	start := time.Now()
+	if _, _, err := request(context.Background(), &buf, &config, ConnInfo{}); err != context.DeadlineExceeded {
+		t.Fatalf("should get error %s but got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("should fail within the resolve timeout but took %v", elapsed)
+	}
+	reply, err := ReadServerReplyMessage(&buf)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if reply.Reply != ReplyHostUnreachable {
+		t.Fatalf("should get reply %d but got %d", ReplyHostUnreachable, reply.Reply)
+	}
+}
+
+// countingResolver resolves every host to 10.0.0.1 and counts lookups.
+type countingResolver struct {
+	lookups int32
+}
+
+func (r *countingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	atomic.AddInt32(&r.lookups, 1)
+	return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, nil
+}
+
+type countingMetrics struct {
+	hits, misses, resolves int32
+}
+
+func (m *countingMetrics) IncDNSCacheHit()                       { atomic.AddInt32(&m.hits, 1) }
+func (m *countingMetrics) IncDNSCacheMiss()                      { atomic.AddInt32(&m.misses, 1) }
+func (m *countingMetrics) ObserveResolveLatency(d time.Duration) { atomic.AddInt32(&m.resolves, 1) }
+
+func TestDNSCacheMetrics(t *testing.T) {
+	resolver := &countingResolver{}
+	metrics := &countingMetrics{}
+	config := Config{
+		AuthMethod:  MethodNoAuth,
+		Resolver:    resolver,
+		DNSCacheTTL: time.Minute,
+		Metrics:     metrics,
+	}
+	if err := initConfig(&config); err != nil {
+		t.Fatalf("init config failure: %s", err)
+	}
+
+	for _, host := range []string{"a.example", "a.example", "b.example", "a.example"} {
+		if _, err := lookupIPs(context.Background(), host, &config); err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+	}
+	if metrics.hits != 2 || metrics.misses != 2 {
+		t.Fatalf("should get 2 hits and 2 misses but got %d and %d", metrics.hits, metrics.misses)
+	}
+	if metrics.resolves != 2 || resolver.lookups != 2 {
+		t.Fatalf("should resolve twice but resolved %d times with %d observed", resolver.lookups, metrics.resolves)
+	}
+}
+
+func TestResolveContext(t *testing.T) {
+	type key struct{}
+	resolver := blockingResolver{looked: make(chan context.Context, 1)}
+	config := &Config{
+		AuthMethod: MethodNoAuth,
+		Resolver:   resolver,
+		OnConnect: func(ctx context.Context, info ConnInfo) context.Context {
+			return context.WithValue(ctx, key{}, "tenant")
+		},
+	}
+	if err := initConfig(config); err != nil {
+		t.Fatalf("init config failure: %s", err)
+	}
+	server := &SOCKS5Server{Config: config}
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- server.ServeConn(ctx, conn) }()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	go func() {
+		WriteClientAuthMessage(client, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+		WriteClientRequestMessage(client, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeDomain, Address: "slow.example", Port: 80})
+	}()
+	if _, err := ReadServerAuthMessage(client); err != nil {
+		t.Fatalf("read auth reply failure: %s", err)
+	}
+
+	// Cancelling the connection aborts the lookup without a ResolveTimeout
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case lookupCtx := <-resolver.looked:
+		if value := lookupCtx.Value(key{}); value != "tenant" {
+			t.Fatalf("should see the value set by OnConnect but got %v", value)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("should abort the lookup once the connection is cancelled")
+	}
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("should return once the lookup is aborted")
+	}
+}
+
+func TestDNSCacheExpiry(t *testing.T) {
+	cache := newDNSCache(&Config{DNSCacheTTL: time.Millisecond, DNSCacheSize: 2})
+	addrs := []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}
+	cache.put("a.example", addrs)
+	if _, ok := cache.get("a.example"); !ok {
+		t.Fatalf("should get cached addresses")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := cache.get("a.example"); ok {
+		t.Fatalf("should not get expired addresses")
+	}
+
+	for _, host := range []string{"b.example", "c.example", "d.example"} {
+		cache.put(host, addrs)
+	}
+	if len(cache.entries) > 2 {
+		t.Fatalf("should hold at most 2 entries but got %d", len(cache.entries))
+	}
+}
+
+// manyResolver resolves every host to n addresses.
+type manyResolver struct {
+	n int
+}
+
+func (r manyResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs := make([]net.IPAddr, r.n)
+	for i := range addrs {
+		addrs[i] = net.IPAddr{IP: net.IPv4(192, 0, 2, byte(i+1))}
+	}
+	return addrs, nil
+}
+
+func TestDialCandidates(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Dial     func(ctx context.Context, network, address string) (net.Conn, error)
+		Attempts int32
+	}{
+		// Unreachable addresses that fail right away are only tried up to
+		// MaxDialCandidates.
+		{"Refused", func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+		}, 3},
+		// Blackholed addresses share the DialTimeout budget.
+		{"Blackholed", func(ctx context.Context, network, address string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var attempts int32
+			config := Config{
+				AuthMethod:        MethodNoAuth,
+				Resolver:          manyResolver{n: 50},
+				MaxDialCandidates: 3,
+				DialTimeout:       100 * time.Millisecond,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					atomic.AddInt32(&attempts, 1)
+					return test.Dial(ctx, network, address)
+				},
+			}
+			var buf bytes.Buffer
+			WriteClientRequestMessage(&buf, &ClientRequestMessage{
+				Cmd:      CmdConnect,
+				AddrType: TypeDomain,
+				Address:  "example.com",
+				Port:     80,
+			})
+
+			start := time.Now()
+			if _, _, err := request(context.Background(), &buf, &config, ConnInfo{}); err != ErrConnectionRefused {
+				t.Fatalf("should get error %s but got %v", ErrConnectionRefused, err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("should fail within the dial timeout but took %v", elapsed)
+			}
+			if got := atomic.LoadInt32(&attempts); got != test.Attempts {
+				t.Fatalf("should dial %d addresses but dialed %d", test.Attempts, got)
+			}
+		})
+	}
+}
+
+func TestBalanceTargets(t *testing.T) {
+	dialed := make(chan string, 1)
+	config := Config{
+		AuthMethod:     MethodNoAuth,
+		Resolver:       manyResolver{n: 3},
+		BalanceTargets: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed <- address
+			client, target := net.Pipe()
+			target.Close()
+			return client, nil
+		},
+	}
+	if err := initConfig(&config); err != nil {
+		t.Fatalf("init config failure: %s", err)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		var buf bytes.Buffer
+		WriteClientRequestMessage(&buf, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeDomain, Address: "example.com", Port: 80})
+		_, targetConn, err := request(context.Background(), &buf, &config, ConnInfo{})
+		if err != nil {
+			t.Fatalf("request failure: %s", err)
+		}
+		targetConn.Close()
+		counts[<-dialed]++
+	}
+	for i := 1; i <= 3; i++ {
+		address := fmt.Sprintf("192.0.2.%d:80", i)
+		if counts[address] != 2 {
+			t.Fatalf("should dial %s twice but got %v", address, counts)
+		}
+	}
+}
+
+func TestLogResolution(t *testing.T) {
+	var logs bytes.Buffer
+	w := log.Writer()
+	log.SetOutput(&logs)
+	defer log.SetOutput(w)
+
+	config := Config{
+		AuthMethod:    MethodNoAuth,
+		Resolver:      manyResolver{n: 3},
+		LogResolution: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// The first address is down
+			if address == "192.0.2.1:80" {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+			}
+			client, _ := net.Pipe()
+			remote, _ := net.ResolveTCPAddr(network, address)
+			return &fakeConn{Conn: client, remote: remote}, nil
+		},
+	}
+	if err := initConfig(&config); err != nil {
+		t.Fatalf("init config failure: %s", err)
+	}
+	var buf bytes.Buffer
+	WriteClientRequestMessage(&buf, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeDomain, Address: "example.com", Port: 80})
+	_, targetConn, err := request(context.Background(), &buf, &config, ConnInfo{})
+	if err != nil {
+		t.Fatalf("request failure: %s", err)
+	}
+	targetConn.Close()
+
+	want := "resolution of example.com: [192.0.2.1 192.0.2.2 192.0.2.3] in "
+	if !strings.Contains(logs.String(), want) || !strings.Contains(logs.String(), "connected to 192.0.2.2:80") {
+		t.Fatalf("should log %q and the address connected to but got %q", want, logs.String())
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		Name      string
+		Normalize func(host string) string
+		Domain    string
+	}{
+		{"default", nil, "Echo.Test."},
+		{"custom", func(host string) string { return strings.ToLower(host) }, "ECHO.test"},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			dialed := make(chan string, 1)
+			config := Config{
+				AuthMethod:    MethodNoAuth,
+				Resolver:      staticResolver{"echo.test": net.IPv4(192, 0, 2, 7)},
+				NormalizeHost: test.Normalize,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					dialed <- address
+					client, _ := net.Pipe()
+					return client, nil
+				},
+			}
+			if err := initConfig(&config); err != nil {
+				t.Fatalf("init config failure: %s", err)
+			}
+			var buf bytes.Buffer
+			WriteClientRequestMessage(&buf, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeDomain, Address: test.Domain, Port: 80})
+			message, targetConn, err := request(context.Background(), &buf, &config, ConnInfo{})
+			if err != nil {
+				t.Fatalf("should resolve %q but got %s", test.Domain, err)
+			}
+			targetConn.Close()
+			if message.Address != "echo.test" {
+				t.Fatalf("should normalize %q to echo.test but got %q", test.Domain, message.Address)
+			}
+			if address := <-dialed; address != "192.0.2.7:80" {
+				t.Fatalf("should dial 192.0.2.7:80 but got %s", address)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+var ErrServerNameNotAllowed = errors.New("TLS server name not allowed")
+
+const (
+	tlsRecordHeaderLength  = 5
+	tlsRecordTypeHandshake = 0x16
+	tlsClientHello         = 0x01
+	tlsExtServerName       = 0x0000
+	tlsServerNameHostName  = 0x00
+)
+
+// readClientHello reads the first TLS record sent by the client and returns
+// the server name it asks for, along with every byte read so that they can be
+// replayed to the target. serverName is empty if the record is not a
+// ClientHello carrying an SNI extension.
+func readClientHello(r io.Reader) (serverName string, data []byte, err error) {
+	header := make([]byte, tlsRecordHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, err
+	}
+	if header[0] != tlsRecordTypeHandshake {
+		return "", header, nil
+	}
+
+	length := int(header[3])<<8 | int(header[4])
+	data = make([]byte, tlsRecordHeaderLength+length)
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[tlsRecordHeaderLength:]); err != nil {
+		return "", nil, err
+	}
+	return parseServerName(data[tlsRecordHeaderLength:]), data, nil
+}
+
+// parseServerName extracts the SNI host name from a ClientHello handshake
+// message, returning "" if there is none or the message is malformed.
+func parseServerName(msg []byte) string {
+	// Handshake type, length, client version and random
+	if len(msg) < 4+2+32 || msg[0] != tlsClientHello {
+		return ""
+	}
+	p := msg[4+2+32:]
+
+	// Session ID, cipher suites and compression methods
+	for _, prefix := range []int{1, 2, 1} {
+		if len(p) < prefix {
+			return ""
+		}
+		n := int(p[0])
+		if prefix == 2 {
+			n = n<<8 | int(p[1])
+		}
+		if len(p) < prefix+n {
+			return ""
+		}
+		p = p[prefix+n:]
+	}
+
+	// Extensions
+	if len(p) < 2 {
+		return ""
+	}
+	p = p[2:]
+	for len(p) >= 4 {
+		extType, extLength := int(p[0])<<8|int(p[1]), int(p[2])<<8|int(p[3])
+		if len(p) < 4+extLength {
+			return ""
+		}
+		ext := p[4 : 4+extLength]
+		p = p[4+extLength:]
+		if extType != tlsExtServerName || len(ext) < 2 {
+			continue
+		}
+		list := ext[2:]
+		for len(list) >= 3 {
+			nameType, nameLength := list[0], int(list[1])<<8|int(list[2])
+			if len(list) < 3+nameLength {
+				return ""
+			}
+			if nameType == tlsServerNameHostName {
+				return string(list[3 : 3+nameLength])
+			}
+			list = list[3+nameLength:]
+		}
+	}
+	return ""
+}
+
+// peekServerName answers req with success before its target is dialed and
+// reads the ClientHello the client then sends, recording its server name in
+// req and in the session ctx belongs to. It returns the bytes read, to be
+// replayed to the target.
+func peekServerName(ctx context.Context, config *Config, conn io.ReadWriter, req *Request) ([]byte, error) {
+	if err := WriteRequestSuccessMessage(conn, net.IPv4zero, 0); err != nil {
+		return nil, err
+	}
+	serverName, hello, err := readClientHello(conn)
+	if err != nil {
+		return nil, err
+	}
+	req.ConnInfo.ServerName = serverName
+	if s, ok := ctx.Value(sessionKey{}).(*session); ok {
+		s.setServerName(serverName)
+	}
+	if config.AllowServerName != nil && !config.AllowServerName(serverName, req.ConnInfo) {
+		return nil, ErrServerNameNotAllowed
+	}
+	return hello, nil
+}
+
+// replayClientHello writes the ClientHello read by peekServerName to
+// targetConn, counting it as sent by the client.
+func replayClientHello(ctx context.Context, targetConn io.Writer, hello []byte) error {
+	w := targetConn
+	if s, ok := ctx.Value(sessionKey{}).(*session); ok {
+		w = s.meter.writer(targetConn, true)
+	}
+	_, err := w.Write(hello)
+	return err
+}
+
+// answeredConn drops the replies to a request already answered by
+// peekServerName: the client is speaking TLS by then.
+type answeredConn struct {
+	io.ReadWriter
+}
+
+func (answeredConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
@@ -0,0 +1,140 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+// recordClientHello returns the first TLS record a client sends when asking
+// for serverName.
+func recordClientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+	}()
+
+	header := make([]byte, tlsRecordHeaderLength)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatalf("read record header failure: %s", err)
+	}
+	record := make([]byte, tlsRecordHeaderLength+(int(header[3])<<8|int(header[4])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[tlsRecordHeaderLength:]); err != nil {
+		t.Fatalf("read record failure: %s", err)
+	}
+	return record
+}
+
+func TestReadClientHello(t *testing.T) {
+	hello := recordClientHello(t, "example.com")
+	r := bytes.NewReader(append(append([]byte{}, hello...), "rest"...))
+
+	serverName, data, err := readClientHello(r)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if serverName != "example.com" {
+		t.Fatalf("should get server name example.com but got %q", serverName)
+	}
+	if !bytes.Equal(data, hello) {
+		t.Fatalf("should return the ClientHello bytes unchanged")
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+		t.Fatalf("should leave the following bytes unread but got %q", rest)
+	}
+
+	t.Run("not a TLS handshake", func(t *testing.T) {
+		serverName, data, err := readClientHello(bytes.NewReader([]byte("GET / HTTP/1.1\r\n")))
+		if err != nil || serverName != "" || string(data) != "GET /" {
+			t.Fatalf("should replay the header only but got %q, %q, %v", serverName, data, err)
+		}
+	})
+}
+
+func TestInspectServerName(t *testing.T) {
+	hello := recordClientHello(t, "blocked.example.com")
+	// inspect sends a CONNECT request to port 443 followed by the
+	// ClientHello, and returns the replies and what the target received.
+	inspect := func(config *Config) (*bytes.Buffer, []byte, error) {
+		proxyTarget, target := net.Pipe()
+		defer target.Close()
+		config.AuthMethod = MethodNoAuth
+		config.InspectTLSSNI = true
+		config.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return proxyTarget, nil
+		}
+		if err := initConfig(config); err != nil {
+			t.Fatalf("init config failure: %s", err)
+		}
+		var in, replies bytes.Buffer
+		WriteClientRequestMessage(&in, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeIPv4, Address: "192.0.2.1", Port: 443})
+		in.Write(hello)
+		received := make(chan []byte, 1)
+		go func() {
+			data := make([]byte, len(hello))
+			n, _ := io.ReadFull(target, data)
+			received <- data[:n]
+		}()
+
+		conn := struct {
+			io.Reader
+			io.Writer
+		}{&in, &replies}
+		_, targetConn, err := request(context.Background(), conn, config, ConnInfo{})
+		if err != nil {
+			return &replies, nil, err
+		}
+		defer targetConn.Close()
+		return &replies, <-received, nil
+	}
+
+	t.Run("server name seen before dialing", func(t *testing.T) {
+		var serverName string
+		replies, replayed, err := inspect(&Config{AllowDestination: func(req *Request) error {
+			serverName = req.ConnInfo.ServerName
+			return nil
+		}})
+		if err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+		if serverName != "blocked.example.com" {
+			t.Fatalf("should check server name blocked.example.com but got %q", serverName)
+		}
+		if reply, err := ReadServerReplyMessage(replies); err != nil || reply.Reply != ReplySuccess || replies.Len() != 0 {
+			t.Fatalf("should get a single reply success but got %v, %v", reply, err)
+		}
+		if !bytes.Equal(replayed, hello) {
+			t.Fatalf("should replay the ClientHello to the target")
+		}
+	})
+
+	t.Run("server name rejected", func(t *testing.T) {
+		routed := false
+		config := Config{
+			AllowServerName: func(serverName string, info ConnInfo) bool {
+				return serverName != "blocked.example.com"
+			},
+			Route: func(req *Request) (string, error) {
+				routed = true
+				return "", nil
+			},
+		}
+		replies, _, err := inspect(&config)
+		if err != ErrServerNameNotAllowed {
+			t.Fatalf("should get error %s but got %v", ErrServerNameNotAllowed, err)
+		}
+		if routed {
+			t.Fatalf("should not route a rejected server name")
+		}
+		if reply, err := ReadServerReplyMessage(replies); err != nil || reply.Reply != ReplySuccess || replies.Len() != 0 {
+			t.Fatalf("should get the early reply success only but got %v, %v", reply, err)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package socks5
+
+import (
+	"log"
+)
+
+// noDelaySetter is implemented by *net.TCPConn.
+type noDelaySetter interface {
+	SetNoDelay(noDelay bool) error
+}
+
+// setNoDelay applies noDelay to conn if it is set and conn supports it.
+func setNoDelay(conn interface{}, noDelay *bool) {
+	if noDelay == nil {
+		return
+	}
+	if c, ok := conn.(noDelaySetter); ok {
+		if err := c.SetNoDelay(*noDelay); err != nil {
+			log.Printf("set TCP_NODELAY failure: %s", err)
+		}
+	}
+}
+
+// bufferSetter is implemented by *net.TCPConn.
+type bufferSetter interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// setBuffers applies config.ReadBufferSize and config.WriteBufferSize to conn
+// if they are set and conn supports it, and logs sizes clamped by the OS.
+func setBuffers(conn interface{}, config *Config) {
+	c, ok := conn.(bufferSetter)
+	if !ok || (config.ReadBufferSize == 0 && config.WriteBufferSize == 0) {
+		return
+	}
+	if config.ReadBufferSize > 0 {
+		if err := c.SetReadBuffer(config.ReadBufferSize); err != nil {
+			log.Printf("set read buffer failure: %s", err)
+		}
+	}
+	if config.WriteBufferSize > 0 {
+		if err := c.SetWriteBuffer(config.WriteBufferSize); err != nil {
+			log.Printf("set write buffer failure: %s", err)
+		}
+	}
+	if read, write, ok := socketBuffers(conn); ok {
+		if read < config.ReadBufferSize {
+			log.Printf("read buffer clamped to %d bytes instead of %d", read, config.ReadBufferSize)
+		}
+		if write < config.WriteBufferSize {
+			log.Printf("write buffer clamped to %d bytes instead of %d", write, config.WriteBufferSize)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+//go:build linux
+
+package socks5
+
+import (
+	"syscall"
+)
+
+// socketBuffers returns the sizes of the receive and send buffers of conn
+// as requested, i.e. without the bookkeeping overhead Linux doubles them by.
+func socketBuffers(conn interface{}) (read, write int, ok bool) {
+	sc, isSyscallConn := conn.(syscall.Conn)
+	if !isSyscallConn {
+		return 0, 0, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+	var readErr, writeErr error
+	if err := raw.Control(func(fd uintptr) {
+		read, readErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		write, writeErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	}); err != nil || readErr != nil || writeErr != nil {
+		return 0, 0, false
+	}
+	return read / 2, write / 2, true
+}
@@ -0,0 +1,38 @@
+//go:build linux
+
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestTargetNoDelay(t *testing.T) {
+	clientNoDelay, targetNoDelay := true, false
+	config := Config{TargetNetwork: "tcp", ClientNoDelay: &clientNoDelay, TargetNoDelay: &targetNoDelay}
+
+	var buf bytes.Buffer
+	targetConn, err := requestConnect(context.Background(), &config, []string{startEchoServer(t)}, 0, nil, &buf)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	defer targetConn.Close()
+
+	raw, err := targetConn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	var noDelay int
+	raw.Control(func(fd uintptr) {
+		noDelay, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	})
+	if err != nil {
+		t.Skipf("reading TCP_NODELAY not supported: %s", err)
+	}
+	if noDelay != 0 {
+		t.Fatalf("should enable Nagle on the target connection but TCP_NODELAY is %d", noDelay)
+	}
+}
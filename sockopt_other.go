@@ -0,0 +1,8 @@
+//go:build !linux
+
+package socks5
+
+// socketBuffers is not supported outside Linux.
+func socketBuffers(conn interface{}) (read, write int, ok bool) {
+	return 0, 0, false
+}
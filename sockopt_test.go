@@ -0,0 +1,92 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+)
+
+// noDelayConn records the SetNoDelay calls made on it.
+type noDelayConn struct {
+	net.Conn
+	calls []bool
+}
+
+func (c *noDelayConn) SetNoDelay(noDelay bool) error {
+	c.calls = append(c.calls, noDelay)
+	return nil
+}
+
+func TestClientNoDelay(t *testing.T) {
+	clientNoDelay, targetNoDelay := false, true
+	config := Config{AuthMethod: MethodNoAuth, ClientNoDelay: &clientNoDelay, TargetNoDelay: &targetNoDelay}
+
+	client, server := net.Pipe()
+	client.Close()
+	conn := &noDelayConn{Conn: server}
+	handleConnection(&session{conn: conn}, &config)
+	if len(conn.calls) != 1 || conn.calls[0] != clientNoDelay {
+		t.Fatalf("should set client no delay to %v once but got %v", clientNoDelay, conn.calls)
+	}
+
+	conn = &noDelayConn{Conn: server}
+	handleConnection(&session{conn: conn}, &Config{AuthMethod: MethodNoAuth})
+	if len(conn.calls) != 0 {
+		t.Fatalf("should leave client no delay unset but got %v", conn.calls)
+	}
+}
+
+// bufferConn records the socket buffer sizes set on it.
+type bufferConn struct {
+	net.Conn
+	read, write int
+}
+
+func (c *bufferConn) SetReadBuffer(bytes int) error {
+	c.read = bytes
+	return nil
+}
+
+func (c *bufferConn) SetWriteBuffer(bytes int) error {
+	c.write = bytes
+	return nil
+}
+
+func TestBufferSizes(t *testing.T) {
+	config := Config{AuthMethod: MethodNoAuth, ReadBufferSize: 1 << 20, WriteBufferSize: 512 << 10}
+
+	t.Run("client", func(t *testing.T) {
+		client, server := net.Pipe()
+		client.Close()
+		conn := &bufferConn{Conn: server}
+		handleConnection(&session{conn: conn}, &config)
+		if conn.read != config.ReadBufferSize || conn.write != config.WriteBufferSize {
+			t.Fatalf("should set buffers to %d/%d but got %d/%d", config.ReadBufferSize, config.WriteBufferSize, conn.read, conn.write)
+		}
+	})
+
+	t.Run("target", func(t *testing.T) {
+		var target *bufferConn
+		config := config
+		config.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			server.Close()
+			target = &bufferConn{Conn: client}
+			return target, nil
+		}
+		var buf bytes.Buffer
+		if _, err := requestConnect(context.Background(), &config, []string{"10.0.0.1:80"}, 0, nil, &buf); err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+		if target.read != config.ReadBufferSize || target.write != config.WriteBufferSize {
+			t.Fatalf("should set buffers to %d/%d but got %d/%d", config.ReadBufferSize, config.WriteBufferSize, target.read, target.write)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		if err := initConfig(&Config{ReadBufferSize: -1}); err != ErrInvalidBufferSize {
+			t.Fatalf("should get error %s but got %v", ErrInvalidBufferSize, err)
+		}
+	})
+}
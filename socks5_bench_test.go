@@ -0,0 +1,92 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"testing"
+)
+
+var benchmarkSizes = []int{1 << 10, 64 << 10, 1 << 20}
+
+// BenchmarkForward measures the copy loop of forward alone.
+func BenchmarkForward(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			payload := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				client, proxyClient := net.Pipe()
+				proxyTarget, target := net.Pipe()
+				done := make(chan struct{})
+				go func() {
+					io.CopyN(io.Discard, target, int64(size))
+					target.Close()
+					close(done)
+				}()
+				go forward(proxyClient, proxyTarget, forwardOptions{})
+				client.Write(payload)
+				client.Close()
+				<-done
+			}
+		})
+	}
+}
+
+// BenchmarkForwardThroughput measures a full CONNECT followed by a bulk
+// upload, entirely in memory.
+func BenchmarkForwardThroughput(b *testing.B) {
+	w := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(w)
+
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			done := make(chan struct{})
+			config := &Config{
+				AuthMethod: MethodNoAuth,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					proxyTarget, target := net.Pipe()
+					go func() {
+						io.CopyN(io.Discard, target, int64(size))
+						target.Close()
+						done <- struct{}{}
+					}()
+					return proxyTarget, nil
+				},
+			}
+			if err := initConfig(config); err != nil {
+				b.Fatalf("init config failure: %s", err)
+			}
+			listener := newMemListener()
+			defer listener.Close()
+			server := &SOCKS5Server{Config: config}
+			go server.Serve(listener)
+
+			payload := make([]byte, size)
+			request := &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeIPv4, Address: "10.0.0.1", Port: 80}
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				conn, err := listener.Dial()
+				if err != nil {
+					b.Fatalf("dial failure: %s", err)
+				}
+				WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+				ReadServerAuthMessage(conn)
+				WriteClientRequestMessage(conn, request)
+				if reply, err := ReadServerReplyMessage(conn); err != nil || reply.Reply != ReplySuccess {
+					b.Fatalf("should get reply success but got %v, %v", reply, err)
+				}
+				conn.Write(payload)
+				conn.Close()
+				<-done
+			}
+		})
+	}
+}
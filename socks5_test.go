@@ -2,9 +2,18 @@ package socks5
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
 	"net"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestAuth(t *testing.T) {
@@ -15,7 +24,7 @@ func TestAuth(t *testing.T) {
 	t.Run("a valid client auth message", func(t *testing.T) {
 		var buf bytes.Buffer
 		buf.Write([]byte{SOCKS5Version, 2, MethodNoAuth, MethodGSSAPI})
-		if err := auth(&buf, &config); err != nil {
+		if _, _, err := auth(&buf, &config, nil); err != nil {
 			t.Fatalf("should get error nil but got %s", err)
 		}
 
@@ -29,7 +38,7 @@ func TestAuth(t *testing.T) {
 	t.Run("an invalid client auth message", func(t *testing.T) {
 		var buf bytes.Buffer
 		buf.Write([]byte{SOCKS5Version, 2, MethodNoAuth})
-		if err := auth(&buf, &config); err == nil {
+		if _, _, err := auth(&buf, &config, nil); err == nil {
 			t.Fatalf("should get error EOF but got nil")
 		}
 	})
@@ -50,3 +59,1079 @@ func TestWriteRequestSuccessMessage(t *testing.T) {
 		t.Fatalf("message not match: want %v, got %v", want, got)
 	}
 }
+
+func TestReplyBindHost(t *testing.T) {
+	_, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth, ReplyBindHost: "proxy.example.com"})
+	_, reply := connectRequest(t, proxyAddr, startEchoServer(t))
+	if reply.AddrType != TypeDomain || reply.Address != "proxy.example.com" || reply.Port == 0 {
+		t.Fatalf("should get bound address proxy.example.com with a port but got %+v", reply)
+	}
+
+	config := Config{AuthMethod: MethodNoAuth, ReplyBindHost: strings.Repeat("a", 256)}
+	if err := initConfig(&config); err != ErrReplyBindHostTooLong {
+		t.Fatalf("should get error %s but got %v", ErrReplyBindHostTooLong, err)
+	}
+}
+
+func TestRequestTargetNetwork(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	host := "localhost"
+	var buf bytes.Buffer
+	buf.Write([]byte{SOCKS5Version, CmdConnect, ReservedField, TypeDomain, byte(len(host))})
+	buf.WriteString(host)
+	buf.Write([]byte{byte(port >> 8), byte(port)})
+
+	config := Config{AuthMethod: MethodNoAuth, TargetNetwork: "tcp4"}
+	if err := initConfig(&config); err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	_, targetConn, err := request(context.Background(), &buf, &config, ConnInfo{})
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	defer targetConn.Close()
+
+	conn := <-accepted
+	defer conn.Close()
+	if ip := conn.RemoteAddr().(*net.TCPAddr).IP; ip.To4() == nil {
+		t.Fatalf("should dial target over IPv4 but got %s", ip)
+	}
+}
+
+func TestInitConfigTargetNetwork(t *testing.T) {
+	config := Config{AuthMethod: MethodNoAuth, TargetNetwork: "udp"}
+	if err := initConfig(&config); err != ErrTargetNetworkNotSupported {
+		t.Fatalf("should get error %s but got %v", ErrTargetNetworkNotSupported, err)
+	}
+}
+
+func TestInitConfigTLSVersion(t *testing.T) {
+	tests := []struct {
+		Name       string
+		MinVersion uint16
+		Insecure   bool
+		Want       uint16
+		Err        error
+	}{
+		{"TLS 1.3", tls.VersionTLS13, false, tls.VersionTLS13, nil},
+		{"TLS 1.2", tls.VersionTLS12, false, tls.VersionTLS12, nil},
+		{"default", 0, false, tls.VersionTLS12, nil},
+		{"TLS 1.0", tls.VersionTLS10, false, 0, ErrInsecureTLSVersion},
+		{"TLS 1.0 allowed", tls.VersionTLS10, true, tls.VersionTLS10, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			config := Config{
+				AuthMethod:       MethodNoAuth,
+				TLSConfig:        &tls.Config{MinVersion: test.MinVersion},
+				AllowInsecureTLS: test.Insecure,
+			}
+			err := initConfig(&config)
+			if !errors.Is(err, test.Err) {
+				t.Fatalf("should get error %v but got %v", test.Err, err)
+			}
+			if err == nil && config.TLSConfig.MinVersion != test.Want {
+				t.Fatalf("should get minimum version %#04x but got %#04x", test.Want, config.TLSConfig.MinVersion)
+			}
+		})
+	}
+}
+
+// startServer serves config on an ephemeral loopback port.
+func startServer(t *testing.T, config *Config) (*SOCKS5Server, string) {
+	t.Helper()
+	if err := initConfig(config); err != nil {
+		t.Fatalf("init config failure: %s", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := &SOCKS5Server{Config: config}
+	go server.Serve(listener)
+	return server, listener.Addr().String()
+}
+
+// startEchoServer starts a TCP server echoing back everything it reads.
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// dialConnect performs a no-auth handshake and a CONNECT to target through
+// the proxy at proxyAddr.
+func dialConnect(t *testing.T, proxyAddr, target string) net.Conn {
+	t.Helper()
+	conn, reply := connectRequest(t, proxyAddr, target)
+	if reply.Reply != ReplySuccess {
+		t.Fatalf("should get reply success but got %d", reply.Reply)
+	}
+	return conn
+}
+
+// connectRequest sends a CONNECT request for target through the proxy at
+// proxyAddr and returns the connection along with the reply.
+func connectRequest(t *testing.T, proxyAddr, target string) (net.Conn, *ServerReplyMessage) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy failure: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		t.Fatalf("split target failure: %s", err)
+	}
+	portNum, _ := strconv.Atoi(port)
+	var buf bytes.Buffer
+	WriteClientAuthMessage(&buf, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+	WriteClientRequestMessage(&buf, &ClientRequestMessage{
+		Cmd:      CmdConnect,
+		AddrType: TypeIPv4,
+		Address:  host,
+		Port:     uint16(portNum),
+	})
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatalf("write handshake failure: %s", err)
+	}
+
+	if _, err := ReadServerAuthMessage(conn); err != nil {
+		t.Fatalf("read auth reply failure: %s", err)
+	}
+	reply, err := ReadServerReplyMessage(conn)
+	if err != nil {
+		t.Fatalf("read request reply failure: %s", err)
+	}
+	return conn, reply
+}
+
+// failingListener fails every Accept with err.
+type failingListener struct {
+	net.Listener
+	err error
+}
+
+func (l failingListener) Accept() (net.Conn, error) {
+	return nil, l.err
+}
+
+func TestServeClosesListener(t *testing.T) {
+	address := "127.0.0.1:0"
+	errPermanent := errors.New("permanent failure")
+	for i := 0; i < 10; i++ {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			t.Fatalf("iteration %d: should reuse %s but got %s", i, address, err)
+		}
+		address = listener.Addr().String()
+
+		server := &SOCKS5Server{Config: &Config{AuthMethod: MethodNoAuth}}
+		if err := server.Serve(failingListener{listener, errPermanent}); err != errPermanent {
+			t.Fatalf("should get error %s but got %v", errPermanent, err)
+		}
+	}
+}
+
+func TestMaxBytesPerConn(t *testing.T) {
+	const limit = 64 * 1024
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(make([]byte, 4*limit))
+	}()
+
+	closed := make(chan ConnStats, 1)
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod:      MethodNoAuth,
+		MaxBytesPerConn: limit,
+		OnClose:         func(stats ConnStats) { closed <- stats },
+	})
+	conn := dialConnect(t, proxyAddr, listener.Addr().String())
+
+	n, err := io.Copy(io.Discard, conn)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if n != limit {
+		t.Fatalf("should receive %d bytes but got %d", limit, n)
+	}
+
+	stats := <-closed
+	if stats.Err != ErrQuotaExceeded {
+		t.Fatalf("should get error %s but got %v", ErrQuotaExceeded, stats.Err)
+	}
+	if stats.Reason != CloseQuotaExceeded {
+		t.Fatalf("should get reason %s but got %s", CloseQuotaExceeded, stats.Reason)
+	}
+	if stats.BytesDown != limit {
+		t.Fatalf("should count %d bytes down but got %d", limit, stats.BytesDown)
+	}
+}
+
+func TestForwardHalfClose(t *testing.T) {
+	const size = 4 << 20
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	defer listener.Close()
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Close the target to client direction right away.
+		conn.(*net.TCPConn).CloseWrite()
+		n, _ := io.Copy(io.Discard, conn)
+		received <- n
+	}()
+
+	_, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth})
+	conn := dialConnect(t, proxyAddr, listener.Addr().String())
+	if _, err := conn.Write(make([]byte, size)); err != nil {
+		t.Fatalf("write failure: %s", err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	if n := <-received; n != size {
+		t.Fatalf("should receive %d bytes but got %d", size, n)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("should get error EOF but got %v", err)
+	}
+}
+
+// TestForwardWithoutHalfClose checks that EOF reaches a target that cannot
+// be half-closed, such as one end of net.Pipe, by closing it.
+func TestForwardWithoutHalfClose(t *testing.T) {
+	const size = 64 << 10
+	client, proxyClient := net.Pipe()
+	proxyTarget, target := net.Pipe()
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(io.Discard, target)
+		target.Close()
+		received <- n
+	}()
+	done := make(chan error, 1)
+	go func() { done <- forward(proxyClient, proxyTarget, forwardOptions{}) }()
+
+	if _, err := client.Write(make([]byte, size)); err != nil {
+		t.Fatalf("write failure: %s", err)
+	}
+	client.Close()
+
+	select {
+	case n := <-received:
+		if n != size {
+			t.Fatalf("should receive %d bytes but got %d", size, n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("should pass EOF on to the target")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("should get no error but got %s", err)
+	}
+}
+
+// TestClientHalfClose checks that a client can close its write side and
+// still read the response, as HTTP/1.0 clients marking the end of a request
+// with FIN do.
+func TestClientHalfClose(t *testing.T) {
+	const request = "GET / HTTP/1.0\r\n\r\n"
+	const response = "HTTP/1.0 200 OK\r\nContent-Length: 5\r\n\r\nhello"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Answer only once the request is complete, i.e. at EOF
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+		conn.Write([]byte(response))
+	}()
+
+	_, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth})
+	conn := dialConnect(t, proxyAddr, listener.Addr().String())
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("write failure: %s", err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	if data := <-received; data != request {
+		t.Fatalf("should receive request %q but got %q", request, data)
+	}
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read response failure: %s", err)
+	}
+	if string(data) != response {
+		t.Fatalf("should get response %q but got %q", response, data)
+	}
+}
+
+func TestAllowDestination(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Err   error
+		Reply ReplyType
+	}{
+		{"custom reply", &RejectError{Reply: ReplyHostUnreachable}, ReplyHostUnreachable},
+		{"default reply", errors.New("denied"), ReplyConnectionNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			config := Config{
+				AuthMethod: MethodNoAuth,
+				AllowDestination: func(req *Request) error {
+					if req.Address != "10.0.0.1" || req.Port != 25 {
+						t.Fatalf("should get request for 10.0.0.1:25 but got %s:%d", req.Address, req.Port)
+					}
+					return test.Err
+				},
+			}
+			var buf bytes.Buffer
+			WriteClientRequestMessage(&buf, &ClientRequestMessage{
+				Cmd:      CmdConnect,
+				AddrType: TypeIPv4,
+				Address:  "10.0.0.1",
+				Port:     25,
+			})
+			if _, _, err := request(context.Background(), &buf, &config, ConnInfo{}); err != test.Err {
+				t.Fatalf("should get error %s but got %v", test.Err, err)
+			}
+			reply, err := ReadServerReplyMessage(&buf)
+			if err != nil {
+				t.Fatalf("should get error nil but got %s", err)
+			}
+			if reply.Reply != test.Reply {
+				t.Fatalf("should get reply %d but got %d", test.Reply, reply.Reply)
+			}
+		})
+	}
+}
+
+// closedClient is a client that went away: every write fails.
+type closedClient struct {
+	bytes.Buffer
+}
+
+func (c *closedClient) Write(p []byte) (int, error) {
+	return 0, net.ErrClosed
+}
+
+func TestRequestConnectClientGone(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	defer listener.Close()
+	readErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			readErr <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	targetConn, err := requestConnect(context.Background(), &Config{TargetNetwork: "tcp"}, []string{listener.Addr().String()}, 0, nil, &closedClient{})
+	if err != net.ErrClosed {
+		t.Fatalf("should get error %s but got %v", net.ErrClosed, err)
+	}
+	if targetConn != nil {
+		t.Fatalf("should not return the target connection")
+	}
+	if err := <-readErr; err != io.EOF {
+		t.Fatalf("target connection should be closed but got %v", err)
+	}
+}
+
+func TestHandshakeErrorStage(t *testing.T) {
+	passwordConfig := Config{
+		AuthMethod:      MethodPassword,
+		PasswordChecker: func(username, password string) bool { return false },
+	}
+	tests := []struct {
+		Name   string
+		Data   []byte
+		Config Config
+		Stage  HandshakeStage
+	}{
+		{"version mismatch", []byte{0x04, 1, MethodNoAuth}, Config{AuthMethod: MethodNoAuth}, StageVersion},
+		{"unsupported method", []byte{SOCKS5Version, 1, MethodNoAuth}, passwordConfig, StageMethod},
+		{"auth version mismatch", []byte{SOCKS5Version, 1, MethodPassword, 0x02, 0, 0}, passwordConfig, StageAuthVersion},
+		{"password failure", []byte{SOCKS5Version, 1, MethodPassword, PasswordMethodVersion, 1, 'a', 1, 'b'}, passwordConfig, StagePassword},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			_, _, err := auth(bytes.NewBuffer(test.Data), &test.Config, nil)
+			var handshakeErr HandshakeError
+			if !errors.As(err, &handshakeErr) {
+				t.Fatalf("should get a HandshakeError but got %v", err)
+			}
+			if handshakeErr.Stage() != test.Stage {
+				t.Fatalf("should fail at stage %s but got %s", test.Stage, handshakeErr.Stage())
+			}
+		})
+	}
+
+	t.Run("authenticator failure", func(t *testing.T) {
+		errUnavailable := errors.New("ldap unavailable")
+		config := Config{
+			AuthMethod: MethodPassword,
+			Authenticators: []Authenticator{AuthenticatorFunc(func(username, password string) (bool, error) {
+				return false, errUnavailable
+			})},
+		}
+		data := []byte{SOCKS5Version, 1, MethodPassword, PasswordMethodVersion, 1, 'a', 1, 'b'}
+		_, _, err := auth(bytes.NewBuffer(data), &config, nil)
+		var handshakeErr HandshakeError
+		if !errors.As(err, &handshakeErr) || handshakeErr.Stage() != StagePassword {
+			t.Fatalf("should fail at stage %s but got %v", StagePassword, err)
+		}
+		if !errors.Is(err, errUnavailable) {
+			t.Fatalf("should wrap error %s but got %v", errUnavailable, err)
+		}
+	})
+
+	t.Run("reserved field violation", func(t *testing.T) {
+		data := []byte{SOCKS5Version, CmdConnect, 0x01, TypeIPv4, 10, 0, 0, 1, 0, 80}
+		_, err := NewClientRequestMessage(bytes.NewReader(data))
+		var handshakeErr HandshakeError
+		if !errors.As(err, &handshakeErr) || handshakeErr.Stage() != StageReserved {
+			t.Fatalf("should fail at stage %s but got %v", StageReserved, err)
+		}
+	})
+}
+
+func TestForwardNilConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	if err := forward(server, nil, forwardOptions{}); err == nil {
+		t.Fatalf("should get an error for a nil target connection")
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("should close the client connection but got %v", err)
+	}
+
+	client, server = net.Pipe()
+	defer client.Close()
+	if err := forward(nil, server, forwardOptions{}); err == nil {
+		t.Fatalf("should get an error for a nil client connection")
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("should close the target connection but got %v", err)
+	}
+
+	client, server = net.Pipe()
+	defer client.Close()
+	var target *net.TCPConn
+	if err := forward(server, target, forwardOptions{}); err == nil {
+		t.Fatalf("should get an error for a typed nil target connection")
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("should close the client connection but got %v", err)
+	}
+}
+
+func TestForwardClose(t *testing.T) {
+	t.Run("clean", func(t *testing.T) {
+		client, proxyClient := net.Pipe()
+		proxyTarget, target := net.Pipe()
+		done := make(chan error, 1)
+		go func() { done <- forward(proxyClient, proxyTarget, forwardOptions{}) }()
+
+		go func() {
+			io.CopyN(io.Discard, target, 4)
+			target.Close()
+		}()
+		client.Write([]byte("ping"))
+		client.Close()
+		if err := <-done; err != nil {
+			t.Fatalf("should get no error for a clean close but got %s", err)
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen failure: %s", err)
+		}
+		defer listener.Close()
+		dialed := make(chan struct{})
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			<-dialed
+			// Send some data, then abort the connection with a RST
+			conn.Write(make([]byte, 1024))
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}()
+		proxyTarget, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("dial target failure: %s", err)
+		}
+		close(dialed)
+		client, proxyClient := net.Pipe()
+		defer client.Close()
+		go io.Copy(io.Discard, client)
+
+		err = forward(proxyClient, proxyTarget, forwardOptions{})
+		if err == nil {
+			t.Fatalf("should get an error for a reset connection")
+		}
+	})
+}
+
+// memListener is an in-memory net.Listener whose connections are net.Pipe
+// pairs created by Dial.
+type memListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newMemListener() *memListener {
+	return &memListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr{}
+}
+
+// Dial connects to the listener.
+func (l *memListener) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+type memAddr struct{}
+
+func (memAddr) Network() string { return "mem" }
+func (memAddr) String() string  { return "mem" }
+
+func TestForwarder(t *testing.T) {
+	forwarded := make(chan ConnInfo, 1)
+	closed := make(chan ConnStats, 1)
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodNoAuth,
+		Forwarder: func(ctx context.Context, client, target net.Conn, info ConnInfo) error {
+			forwarded <- info
+			return Forward(ctx, client, target, info)
+		},
+		OnClose: func(stats ConnStats) { closed <- stats },
+	})
+	target := startEchoServer(t)
+	conn := dialConnect(t, proxyAddr, target)
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write failure: %s", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("should get echo ping but got %q, %v", buf, err)
+	}
+	if info := <-forwarded; info.Target != target {
+		t.Fatalf("should forward to %s but got %s", target, info.Target)
+	}
+
+	conn.Close()
+	if stats := <-closed; stats.BytesUp != 4 || stats.BytesDown != 4 {
+		t.Fatalf("should count 4 bytes each way but got %d up, %d down", stats.BytesUp, stats.BytesDown)
+	}
+}
+
+func TestForwarderAuth(t *testing.T) {
+	type seen struct {
+		info, fromContext ConnInfo
+	}
+	forwarded := make(chan seen, 1)
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod:      MethodPassword,
+		PasswordChecker: func(username, password string) bool { return password == "secret" },
+		Forwarder: func(ctx context.Context, client, target net.Conn, info ConnInfo) error {
+			fromContext, _ := ConnInfoFromContext(ctx)
+			forwarded <- seen{info, fromContext}
+			return Forward(ctx, client, target, info)
+		},
+	})
+	target := startEchoServer(t)
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy failure: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodPassword}})
+	WriteClientPasswordMessage(conn, &ClientPasswordMessage{Username: "alice", Password: "secret"})
+	WriteClientRequestMessage(conn, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeIPv4, Address: host, Port: uint16(portNum)})
+	ReadServerAuthMessage(conn)
+	ReadServerPasswordMessage(conn)
+	if reply, err := ReadServerReplyMessage(conn); err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should get reply success but got %v, %v", reply, err)
+	}
+
+	got := <-forwarded
+	for _, info := range []ConnInfo{got.info, got.fromContext} {
+		if info.Username != "alice" || info.Method != MethodPassword {
+			t.Fatalf("should see alice authenticated with method %d but got %q with %d", MethodPassword, info.Username, info.Method)
+		}
+	}
+}
+
+func TestOnEmptyTunnel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	defer listener.Close()
+	// The backend drops connections right away, or once the client is done
+	// sending if it is a valid empty tunnel.
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 1)
+				if _, err := conn.Read(buf); err == nil && buf[0] == 'w' {
+					io.Copy(io.Discard, conn)
+				}
+				conn.Close()
+			}()
+		}
+	}()
+
+	empty := make(chan ConnInfo, 1)
+	closed := make(chan ConnStats, 1)
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod:    MethodNoAuth,
+		OnEmptyTunnel: func(info ConnInfo) { empty <- info },
+		OnClose:       func(stats ConnStats) { closed <- stats },
+	})
+
+	t.Run("dropped", func(t *testing.T) {
+		conn := dialConnect(t, proxyAddr, listener.Addr().String())
+		conn.Write([]byte("d"))
+		select {
+		case info := <-empty:
+			if info.Target != listener.Addr().String() {
+				t.Fatalf("should get target %s but got %s", listener.Addr(), info.Target)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("should call OnEmptyTunnel")
+		}
+		conn.Close()
+		<-closed
+	})
+
+	t.Run("valid empty tunnel", func(t *testing.T) {
+		conn := dialConnect(t, proxyAddr, listener.Addr().String())
+		conn.Write([]byte("wait"))
+		conn.(*net.TCPConn).CloseWrite()
+		<-closed
+		select {
+		case info := <-empty:
+			t.Fatalf("should not call OnEmptyTunnel but got %v", info)
+		default:
+		}
+	})
+}
+
+func TestPipelinedHandshake(t *testing.T) {
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod:      MethodPassword,
+		PasswordChecker: func(username, password string) bool { return username == "admin" && password == "123456" },
+	})
+	target := startEchoServer(t)
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy failure: %s", err)
+	}
+	defer conn.Close()
+
+	// Send every handshake message in a single packet
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+	var buf bytes.Buffer
+	WriteClientAuthMessage(&buf, &ClientAuthMessage{Methods: []Method{MethodPassword}})
+	WriteClientPasswordMessage(&buf, &ClientPasswordMessage{Username: "admin", Password: "123456"})
+	WriteClientRequestMessage(&buf, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeIPv4, Address: host, Port: uint16(portNum)})
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatalf("write failure: %s", err)
+	}
+
+	if method, err := ReadServerAuthMessage(conn); err != nil || method != MethodPassword {
+		t.Fatalf("should get method %d but got %d, %v", MethodPassword, method, err)
+	}
+	if status, err := ReadServerPasswordMessage(conn); err != nil || status != PasswordAuthSuccess {
+		t.Fatalf("should get status %d but got %d, %v", PasswordAuthSuccess, status, err)
+	}
+	if reply, err := ReadServerReplyMessage(conn); err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should get reply success but got %v, %v", reply, err)
+	}
+}
+
+func TestRequestWithApplicationData(t *testing.T) {
+	_, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth})
+	target := startEchoServer(t)
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy failure: %s", err)
+	}
+	defer conn.Close()
+
+	// The first application bytes are glued to the request and end up in
+	// the handshake's read buffer
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+	var buf bytes.Buffer
+	WriteClientAuthMessage(&buf, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+	WriteClientRequestMessage(&buf, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeIPv4, Address: host, Port: uint16(portNum)})
+	buf.WriteString("hello")
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatalf("write failure: %s", err)
+	}
+
+	ReadServerAuthMessage(conn)
+	if reply, err := ReadServerReplyMessage(conn); err != nil || reply.Reply != ReplySuccess {
+		t.Fatalf("should get reply success but got %v, %v", reply, err)
+	}
+	echo := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "hello" {
+		t.Fatalf("should get echo hello but got %q, %v", echo, err)
+	}
+}
+
+func TestIdleTimeouts(t *testing.T) {
+	// The target never sends anything
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	closed := make(chan ConnStats, 1)
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod:        MethodNoAuth,
+		ClientIdleTimeout: 100 * time.Millisecond,
+		TargetIdleTimeout: time.Minute,
+		OnClose:           func(stats ConnStats) { closed <- stats },
+	})
+	conn := dialConnect(t, proxyAddr, listener.Addr().String())
+
+	// An active client keeps the tunnel open while the target is silent
+	for i := 0; i < 10; i++ {
+		if _, err := conn.Write([]byte("x")); err != nil {
+			t.Fatalf("write failure: %s", err)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+	select {
+	case stats := <-closed:
+		t.Fatalf("should keep the tunnel open but it closed with %v", stats.Err)
+	default:
+	}
+
+	// A silent client gets the tunnel closed
+	select {
+	case stats := <-closed:
+		if stats.Err != ErrIdleTimeout {
+			t.Fatalf("should get error %s but got %v", ErrIdleTimeout, stats.Err)
+		}
+		if stats.Reason != CloseIdleTimeout {
+			t.Fatalf("should get reason %s but got %s", CloseIdleTimeout, stats.Reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("should close the idle tunnel")
+	}
+}
+
+func TestForwardSetupFailure(t *testing.T) {
+	errBroken := errors.New("broken forwarder")
+	closed := make(chan ConnStats, 1)
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodNoAuth,
+		Forwarder: func(ctx context.Context, client, target net.Conn, info ConnInfo) error {
+			return errBroken
+		},
+		OnClose: func(stats ConnStats) { closed <- stats },
+	})
+	target := startEchoServer(t)
+	conn := dialConnect(t, proxyAddr, target)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("should get error EOF but got %v", err)
+	}
+	stats := <-closed
+	var handshakeErr HandshakeError
+	if !errors.As(stats.Err, &handshakeErr) || handshakeErr.Stage() != StageForwardSetup {
+		t.Fatalf("should fail at stage %s but got %v", StageForwardSetup, stats.Err)
+	}
+	if !errors.Is(stats.Err, errBroken) {
+		t.Fatalf("should get error %s but got %v", errBroken, stats.Err)
+	}
+}
+
+type tenantKey struct{}
+
+func TestConnectionContext(t *testing.T) {
+	requested := make(chan interface{}, 1)
+	closed := make(chan ConnStats, 1)
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodNoAuth,
+		OnConnect: func(ctx context.Context, info ConnInfo) context.Context {
+			return context.WithValue(ctx, tenantKey{}, "acme")
+		},
+		AllowDestination: func(req *Request) error {
+			requested <- req.Context().Value(tenantKey{})
+			return nil
+		},
+		OnClose: func(stats ConnStats) { closed <- stats },
+	})
+	conn := dialConnect(t, proxyAddr, startEchoServer(t))
+	if tenant := <-requested; tenant != "acme" {
+		t.Fatalf("should get tenant acme in AllowDestination but got %v", tenant)
+	}
+
+	conn.Close()
+	stats := <-closed
+	if tenant := stats.Context().Value(tenantKey{}); tenant != "acme" {
+		t.Fatalf("should get tenant acme in OnClose but got %v", tenant)
+	}
+	select {
+	case <-stats.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatalf("should cancel the context once the connection is closed")
+	}
+}
+
+func TestDialLatency(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	tests := []struct {
+		Name    string
+		Timeout time.Duration
+		Reply   ReplyType
+	}{
+		{"Success", 0, ReplySuccess},
+		{"Timeout", delay / 2, ReplyConnectionRefused},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			closed := make(chan ConnStats, 1)
+			_, proxyAddr := startServer(t, &Config{
+				AuthMethod:  MethodNoAuth,
+				DialTimeout: test.Timeout,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					select {
+					case <-time.After(delay):
+					case <-ctx.Done():
+						return nil, ctx.Err()
+					}
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, network, address)
+				},
+				OnClose: func(stats ConnStats) { closed <- stats },
+			})
+			conn, reply := connectRequest(t, proxyAddr, startEchoServer(t))
+			if reply.Reply != test.Reply {
+				t.Fatalf("should get reply %d but got %d", test.Reply, reply.Reply)
+			}
+			conn.Close()
+
+			want := delay
+			if test.Timeout > 0 {
+				want = test.Timeout
+			}
+			if latency := (<-closed).DialLatency; latency < want || latency > want+500*time.Millisecond {
+				t.Fatalf("should get dial latency around %v but got %v", want, latency)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	defer listener.Close()
+	busyPort := listener.Addr().(*net.TCPAddr).Port
+
+	tests := []struct {
+		Name   string
+		Server *SOCKS5Server
+		Err    error // nil with Fails means any error
+		Fails  bool
+	}{
+		{"valid", &SOCKS5Server{IP: "127.0.0.1", Port: 0, Config: &Config{AuthMethod: MethodNoAuth}}, nil, false},
+		{"missing config", &SOCKS5Server{IP: "127.0.0.1"}, ErrConfigNotSet, true},
+		{"missing checker", &SOCKS5Server{IP: "127.0.0.1", Config: &Config{AuthMethod: MethodPassword}}, ErrPasswordCheckerNotSet, true},
+		{"bad target network", &SOCKS5Server{IP: "127.0.0.1", Config: &Config{TargetNetwork: "udp"}}, ErrTargetNetworkNotSupported, true},
+		{"bad port", &SOCKS5Server{IP: "127.0.0.1", Port: 70000, Config: &Config{}}, nil, true},
+		{"port in use", &SOCKS5Server{IP: "127.0.0.1", Port: busyPort, Config: &Config{}}, nil, true},
+		{"admin port in use", &SOCKS5Server{IP: "127.0.0.1", Config: &Config{AdminAddr: listener.Addr().String(), AdminToken: "token"}}, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := test.Server.Validate()
+			if test.Err != nil && err != test.Err {
+				t.Fatalf("should get error %s but got %v", test.Err, err)
+			}
+			if (err != nil) != test.Fails {
+				t.Fatalf("should fail %v but got error %v", test.Fails, err)
+			}
+		})
+	}
+}
+
+func TestPreventSelfConnect(t *testing.T) {
+	_, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth})
+	if _, reply := connectRequest(t, proxyAddr, proxyAddr); reply.Reply != ReplyConnectionNotAllowed {
+		t.Fatalf("should get reply %d but got %d", ReplyConnectionNotAllowed, reply.Reply)
+	}
+
+	allow := false
+	_, proxyAddr = startServer(t, &Config{AuthMethod: MethodNoAuth, PreventSelfConnect: &allow})
+	if _, reply := connectRequest(t, proxyAddr, proxyAddr); reply.Reply != ReplySuccess {
+		t.Fatalf("should get reply %d but got %d", ReplySuccess, reply.Reply)
+	}
+}
+
+func TestRouteUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "echo.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets not available: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodNoAuth,
+		Route: func(req *Request) (string, error) {
+			if req.Port == 9 {
+				return "unix:" + path, nil
+			}
+			return "", nil
+		},
+	})
+	conn, reply := connectRequest(t, proxyAddr, "127.0.0.1:9")
+	if reply.Reply != ReplySuccess || reply.Address != "0.0.0.0" || reply.Port != 0 {
+		t.Fatalf("should get success with bound address 0.0.0.0:0 but got %+v", reply)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write failure: %s", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("should get echo ping but got %q, %v", buf, err)
+	}
+}
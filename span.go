@@ -0,0 +1,51 @@
+package socks5
+
+import "context"
+
+// Names of the spans started with Config.Tracer.
+const (
+	SpanDial    = "socks5.dial"    // dialing the target and replying to the client
+	SpanForward = "socks5.forward" // relaying data between client and target
+)
+
+// Tracer starts spans around the dial and forward phases of CONNECT
+// requests. The function it returns ends the span with the error of the
+// phase, nil on success. Adapters to tracing libraries such as OpenTelemetry
+// read the attributes of the span with SpanAttributesFromContext.
+type Tracer interface {
+	StartSpan(ctx context.Context, name string) (context.Context, func(err error))
+}
+
+// SpanAttributes describe a span started with Config.Tracer. They are
+// complete when the span ends.
+type SpanAttributes struct {
+	Target    string    // target address
+	Reply     ReplyType // reply sent to the client, SpanDial only
+	BytesUp   int64     // client to target, SpanForward only
+	BytesDown int64     // target to client, SpanForward only
+}
+
+type spanAttributesKey struct{}
+
+// SpanAttributesFromContext returns the attributes of the span being started
+// with ctx, or nil if ctx doesn't belong to a span of the server.
+func SpanAttributesFromContext(ctx context.Context) *SpanAttributes {
+	attrs, _ := ctx.Value(spanAttributesKey{}).(*SpanAttributes)
+	return attrs
+}
+
+type nopTracer struct{}
+
+func (nopTracer) StartSpan(ctx context.Context, name string) (context.Context, func(err error)) {
+	return ctx, func(err error) {}
+}
+
+// startSpan starts the span name with config.Tracer, or a no-op span if it is
+// nil.
+func startSpan(ctx context.Context, config *Config, name string, attrs *SpanAttributes) (context.Context, func(err error)) {
+	tracer := config.Tracer
+	if tracer == nil {
+		tracer = nopTracer{}
+	}
+	return tracer.StartSpan(context.WithValue(ctx, spanAttributesKey{}, attrs), name)
+}
@@ -0,0 +1,58 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+)
+
+type endedSpan struct {
+	name  string
+	attrs SpanAttributes
+	err   error
+}
+
+type recordingTracer struct {
+	mu      sync.Mutex
+	started []string
+	ended   chan endedSpan
+}
+
+func (tr *recordingTracer) StartSpan(ctx context.Context, name string) (context.Context, func(err error)) {
+	tr.mu.Lock()
+	tr.started = append(tr.started, name)
+	tr.mu.Unlock()
+	attrs := SpanAttributesFromContext(ctx)
+	return ctx, func(err error) { tr.ended <- endedSpan{name: name, attrs: *attrs, err: err} }
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &recordingTracer{ended: make(chan endedSpan, 2)}
+	_, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth, Tracer: tracer})
+	target := startEchoServer(t)
+	conn := dialConnect(t, proxyAddr, target)
+
+	dial := <-tracer.ended
+	if dial.name != SpanDial || dial.err != nil || dial.attrs.Target != target || dial.attrs.Reply != ReplySuccess {
+		t.Fatalf("should end span %s to %s with success but got %+v", SpanDial, target, dial)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write failure: %s", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("read failure: %s", err)
+	}
+	conn.Close()
+	forward := <-tracer.ended
+	if forward.name != SpanForward || forward.attrs.Target != target || forward.attrs.BytesUp != 4 || forward.attrs.BytesDown != 4 {
+		t.Fatalf("should end span %s to %s with 4 bytes each way but got %+v", SpanForward, target, forward)
+	}
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if len(tracer.started) != 2 || tracer.started[0] != SpanDial || tracer.started[1] != SpanForward {
+		t.Fatalf("should start spans %s and %s but got %v", SpanDial, SpanForward, tracer.started)
+	}
+}
@@ -0,0 +1,90 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// MethodDialTimeout is a private method, like MethodHostnameHint, that
+// behaves like MethodNoAuth except that the client then sends how long the
+// server should try to connect to its target. Servers with a positive
+// Config.MaxClientDialTimeout select it when offered; others ignore it and
+// select MethodNoAuth, in which case the client sends nothing and gets
+// Config.DialTimeout.
+const MethodDialTimeout Method = 0x81
+
+const (
+	DialTimeoutVersion = 0x01
+	DialTimeoutSuccess = 0x00
+)
+
+// NewClientDialTimeoutMessage reads the dial timeout sent by a client that
+// negotiated MethodDialTimeout. Zero asks for the default of the server.
+func NewClientDialTimeoutMessage(conn io.Reader) (time.Duration, error) {
+	// Read version and timeout in milliseconds
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return 0, err
+	}
+	if buf[0] != DialTimeoutVersion {
+		return 0, ErrMethodVersionNotSupported
+	}
+	return time.Duration(binary.BigEndian.Uint32(buf[1:])) * time.Millisecond, nil
+}
+
+// WriteClientDialTimeoutMessage writes the dial timeout sent by a client
+// after the server selected MethodDialTimeout, in milliseconds.
+func WriteClientDialTimeoutMessage(conn io.Writer, timeout time.Duration) error {
+	ms := timeout.Milliseconds()
+	if ms < 0 {
+		ms = 0
+	} else if ms > 1<<32-1 {
+		ms = 1<<32 - 1
+	}
+	buf := []byte{DialTimeoutVersion, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(buf[1:], uint32(ms))
+	_, err := conn.Write(buf)
+	return err
+}
+
+func WriteServerDialTimeoutMessage(conn io.Writer, status byte) error {
+	_, err := conn.Write([]byte{DialTimeoutVersion, status})
+	return err
+}
+
+// ReadServerDialTimeoutMessage reads the status of a dial timeout.
+func ReadServerDialTimeoutMessage(conn io.Reader) (byte, error) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return 0, err
+	}
+	if buf[0] != DialTimeoutVersion {
+		return 0, ErrMethodVersionNotSupported
+	}
+	return buf[1], nil
+}
+
+// clampDialTimeout returns the dial timeout requested by a client, capped at
+// config.MaxClientDialTimeout.
+func clampDialTimeout(config *Config, timeout time.Duration) time.Duration {
+	if timeout > config.MaxClientDialTimeout {
+		return config.MaxClientDialTimeout
+	}
+	return timeout
+}
+
+// dialTimeout returns how long to try connecting to the target of the
+// session ctx belongs to: the timeout its client asked for, if any, or
+// config.DialTimeout.
+func dialTimeout(ctx context.Context, config *Config) time.Duration {
+	if s, ok := ctx.Value(sessionKey{}).(*session); ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.dialTimeout > 0 {
+			return s.dialTimeout
+		}
+	}
+	return config.DialTimeout
+}
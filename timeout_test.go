@@ -0,0 +1,112 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// slowDial never connects, like a backend that doesn't answer, until ctx is
+// done.
+func slowDial(ctx context.Context, network, address string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// timeoutRequest offers MethodDialTimeout and MethodNoAuth to the proxy at
+// proxyAddr, sends timeout if the method is selected and returns how long the
+// CONNECT request then took to be answered.
+func timeoutRequest(t *testing.T, proxyAddr string, timeout time.Duration) (Method, time.Duration) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy failure: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodDialTimeout, MethodNoAuth}})
+	method, err := ReadServerAuthMessage(conn)
+	if err != nil {
+		t.Fatalf("read auth reply failure: %s", err)
+	}
+	if method == MethodDialTimeout {
+		if err := WriteClientDialTimeoutMessage(conn, timeout); err != nil {
+			t.Fatalf("write dial timeout failure: %s", err)
+		}
+		if status, err := ReadServerDialTimeoutMessage(conn); err != nil || status != DialTimeoutSuccess {
+			t.Fatalf("should get dial timeout status success but got %d, %v", status, err)
+		}
+	}
+
+	start := time.Now()
+	WriteClientRequestMessage(conn, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeIPv4, Address: "192.0.2.1", Port: 80})
+	reply, err := ReadServerReplyMessage(conn)
+	if err != nil {
+		t.Fatalf("read request reply failure: %s", err)
+	}
+	if reply.Reply != ReplyConnectionRefused {
+		t.Fatalf("should get reply %d but got %d", ReplyConnectionRefused, reply.Reply)
+	}
+	return method, time.Since(start)
+}
+
+func TestClientDialTimeout(t *testing.T) {
+	t.Run("honored", func(t *testing.T) {
+		_, proxyAddr := startServer(t, &Config{
+			AuthMethod:           MethodNoAuth,
+			Dial:                 slowDial,
+			DialTimeout:          5 * time.Second,
+			MaxClientDialTimeout: 5 * time.Second,
+		})
+		method, elapsed := timeoutRequest(t, proxyAddr, 100*time.Millisecond)
+		if method != MethodDialTimeout {
+			t.Fatalf("should get method %d but got %d", MethodDialTimeout, method)
+		}
+		if elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+			t.Fatalf("should give up after about 100ms but got %s", elapsed)
+		}
+	})
+
+	t.Run("clamped", func(t *testing.T) {
+		_, proxyAddr := startServer(t, &Config{
+			AuthMethod:           MethodNoAuth,
+			Dial:                 slowDial,
+			MaxClientDialTimeout: 100 * time.Millisecond,
+		})
+		if _, elapsed := timeoutRequest(t, proxyAddr, time.Hour); elapsed > 2*time.Second {
+			t.Fatalf("should give up after about 100ms but got %s", elapsed)
+		}
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		_, proxyAddr := startServer(t, &Config{
+			AuthMethod:  MethodNoAuth,
+			Dial:        slowDial,
+			DialTimeout: 100 * time.Millisecond,
+		})
+		method, elapsed := timeoutRequest(t, proxyAddr, time.Hour)
+		if method != MethodNoAuth {
+			t.Fatalf("should get method %d but got %d", MethodNoAuth, method)
+		}
+		if elapsed > 2*time.Second {
+			t.Fatalf("should give up after DialTimeout but got %s", elapsed)
+		}
+	})
+}
+
+func TestDialTimeoutMessage(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteClientDialTimeoutMessage(&buf, 1500*time.Millisecond); err != nil {
+		t.Fatalf("write dial timeout failure: %s", err)
+	}
+	timeout, err := NewClientDialTimeoutMessage(&buf)
+	if err != nil {
+		t.Fatalf("read dial timeout failure: %s", err)
+	}
+	if timeout != 1500*time.Millisecond {
+		t.Fatalf("should get timeout 1.5s but got %s", timeout)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build linux
+
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestTargetTOS(t *testing.T) {
+	target := startEchoServer(t)
+	config := Config{TargetNetwork: "tcp4", TargetTOS: 0x20}
+
+	var buf bytes.Buffer
+	targetConn, err := requestConnect(context.Background(), &config, []string{target}, 0, nil, &buf)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	defer targetConn.Close()
+
+	raw, err := targetConn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	var tos int
+	raw.Control(func(fd uintptr) {
+		tos, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	})
+	if err != nil {
+		t.Skipf("reading IP_TOS not supported: %s", err)
+	}
+	if tos != config.TargetTOS {
+		t.Fatalf("should set TOS %#x but got %#x", config.TargetTOS, tos)
+	}
+}
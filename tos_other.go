@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+
+package socks5
+
+import (
+	"syscall"
+)
+
+// setTOS is a no-op where the TOS cannot be set.
+func setTOS(network string, c syscall.RawConn, tos int) error {
+	return nil
+}
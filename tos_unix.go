@@ -0,0 +1,23 @@
+//go:build linux || darwin || freebsd
+
+package socks5
+
+import (
+	"syscall"
+)
+
+// setTOS sets the IPv4 TOS or the IPv6 traffic class of the socket c.
+func setTOS(network string, c syscall.RawConn, tos int) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if network == "tcp6" || network == "udp6" {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+		} else {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,66 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// Directions reported to Config.HandshakeTracer.
+const (
+	TraceRecv = "recv" // client to server
+	TraceSend = "send" // server to client
+)
+
+// tracingConn reports every byte read from and written to rw.
+type tracingConn struct {
+	rw     io.ReadWriter
+	remote net.Addr
+	trace  func(remote net.Addr, direction string, data []byte)
+}
+
+func (c *tracingConn) Read(p []byte) (int, error) {
+	n, err := c.rw.Read(p)
+	if n > 0 {
+		c.trace(c.remote, TraceRecv, p[:n])
+	}
+	return n, err
+}
+
+func (c *tracingConn) Write(p []byte) (int, error) {
+	c.trace(c.remote, TraceSend, p)
+	return c.rw.Write(p)
+}
+
+// budgetReader fails with ErrHandshakeTooLarge once more than remaining
+// bytes are read from the client.
+type budgetReader struct {
+	io.ReadWriter
+	remaining int
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, ErrHandshakeTooLarge
+	}
+	if len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.ReadWriter.Read(p)
+	r.remaining -= n
+	return n, err
+}
+
+// deadlineWriter bounds every write to the client with timeout, so that a
+// client that doesn't read can't hold the handshake up.
+type deadlineWriter struct {
+	io.ReadWriter
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	defer w.conn.SetWriteDeadline(time.Time{})
+	return w.ReadWriter.Write(p)
+}
@@ -0,0 +1,101 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandshakeTracer(t *testing.T) {
+	var mu sync.Mutex
+	traced := map[string]*bytes.Buffer{TraceRecv: {}, TraceSend: {}}
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodNoAuth,
+		HandshakeTracer: func(remote net.Addr, direction string, data []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			traced[direction].Write(data)
+		},
+	})
+	dialConnect(t, proxyAddr, startEchoServer(t))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := traced[TraceRecv].Bytes(); !bytes.HasPrefix(got, []byte{SOCKS5Version, 1, MethodNoAuth}) {
+		t.Fatalf("should trace method selection %v but got %v", []byte{SOCKS5Version, 1, MethodNoAuth}, got)
+	}
+	if got := traced[TraceSend].Bytes(); !bytes.HasPrefix(got, []byte{SOCKS5Version, MethodNoAuth}) {
+		t.Fatalf("should trace method reply %v but got %v", []byte{SOCKS5Version, MethodNoAuth}, got)
+	}
+}
+
+func TestMaxHandshakeBytes(t *testing.T) {
+	closed := make(chan ConnStats, 2)
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod:        MethodPassword,
+		PasswordChecker:   func(username, password string) bool { return true },
+		MaxHandshakeBytes: 64,
+		OnClose:           func(stats ConnStats) { closed <- stats },
+	})
+	target := startEchoServer(t)
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+
+	handshake := func(username string) {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("dial proxy failure: %s", err)
+		}
+		defer conn.Close()
+		var buf bytes.Buffer
+		WriteClientAuthMessage(&buf, &ClientAuthMessage{Methods: []Method{MethodPassword}})
+		WriteClientPasswordMessage(&buf, &ClientPasswordMessage{Username: username, Password: "secret"})
+		WriteClientRequestMessage(&buf, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeIPv4, Address: host, Port: uint16(portNum)})
+		conn.Write(buf.Bytes())
+		// Wait for the auth, password and request replies, or the abort
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		io.ReadFull(conn, make([]byte, 2+2+10))
+	}
+
+	handshake("admin")
+	if stats := <-closed; stats.Err != nil {
+		t.Fatalf("should accept a handshake within the budget but got %s", stats.Err)
+	}
+	handshake(strings.Repeat("a", 255))
+	if stats := <-closed; !errors.Is(stats.Err, ErrHandshakeTooLarge) {
+		t.Fatalf("should get error %s but got %v", ErrHandshakeTooLarge, stats.Err)
+	}
+}
+
+func TestReplyWriteTimeout(t *testing.T) {
+	config := Config{AuthMethod: MethodNoAuth, ReplyWriteTimeout: 100 * time.Millisecond}
+	if err := initConfig(&config); err != nil {
+		t.Fatalf("init config failure: %s", err)
+	}
+	// Writes to a net.Pipe block until the other end reads, like writes to
+	// a client with a full receive window
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() { done <- handleConnection(&session{conn: server}, &config) }()
+
+	// Send the method selection and never read the reply
+	if err := WriteClientAuthMessage(client, &ClientAuthMessage{Methods: []Method{MethodNoAuth}}); err != nil {
+		t.Fatalf("write auth message failure: %s", err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("should get error %s but got %v", os.ErrDeadlineExceeded, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("should abort the handshake within the timeout")
+	}
+}
@@ -0,0 +1,55 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+var ErrTransparentModeNotSupported = errors.New("transparent mode not supported on this platform")
+
+// handleTransparent forwards a connection redirected to the server by the
+// firewall to its original destination, without any SOCKS negotiation.
+func handleTransparent(sess *session, config *Config) error {
+	dst, err := originalDst(sess.conn)
+	if err != nil {
+		return err
+	}
+	addrType := TypeIPv4
+	if dst.IP.To4() == nil {
+		addrType = TypeIPv6
+	}
+	req := &Request{
+		ClientRequestMessage: ClientRequestMessage{Cmd: CmdConnect, AddrType: addrType, Address: dst.IP.String(), Port: uint16(dst.Port)},
+		ConnInfo:             sess.snapshot(),
+		IPs:                  []net.IP{dst.IP},
+		ctx:                  sess.context(),
+	}
+	if config.AllowDestination != nil {
+		if err := config.AllowDestination(req); err != nil {
+			return err
+		}
+	}
+
+	// There is no client to reply to
+	targetConn, err := requestConnect(req.Context(), config, []string{dst.String()}, sourcePort(config, req), targetTLS(config, req), io.Discard)
+	if err != nil {
+		return err
+	}
+	sess.setTarget(net.JoinHostPort(req.Address, strconv.Itoa(dst.Port)), targetConn)
+	return tunnel(sess, config, sess.conn, targetConn)
+}
+
+// parseOriginalDst parses the address and port of the sockaddr_in, or the
+// sockaddr_in6 if ipv6 is set, in b.
+func parseOriginalDst(b []byte, ipv6 bool) (*net.TCPAddr, error) {
+	if (!ipv6 && len(b) < 8) || (ipv6 && len(b) < 24) {
+		return nil, errors.New("original destination too short")
+	}
+	port := int(b[2])<<8 | int(b[3])
+	if ipv6 {
+		return &net.TCPAddr{IP: append(net.IP{}, b[8:24]...), Port: port}, nil
+	}
+	return &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: port}, nil
+}
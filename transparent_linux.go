@@ -0,0 +1,53 @@
+//go:build linux
+
+package socks5
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST, and IP6T_SO_ORIGINAL_DST which has the
+// same value, from linux/netfilter_ipv4.h.
+const soOriginalDst = 80
+
+// originalDst returns the destination conn was addressed to before being
+// redirected to the server by netfilter.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("original destination requires a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ip := addrIP(conn.LocalAddr())
+	ipv6 := ip != nil && ip.To4() == nil
+
+	// The getsockopt wrappers of the syscall package for structures of the
+	// right size are used to read the socket addresses.
+	var b []byte
+	var optErr error
+	if err := raw.Control(func(fd uintptr) {
+		if ipv6 {
+			var info *syscall.IPv6MTUInfo
+			if info, optErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); optErr == nil {
+				b = (*[syscall.SizeofSockaddrInet6]byte)(unsafe.Pointer(&info.Addr))[:]
+			}
+		} else {
+			var mreq *syscall.IPv6Mreq
+			if mreq, optErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); optErr == nil {
+				b = mreq.Multiaddr[:]
+			}
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if optErr != nil {
+		return nil, optErr
+	}
+	return parseOriginalDst(b, ipv6)
+}
@@ -0,0 +1,36 @@
+//go:build linux
+
+package socks5
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOriginalDst(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failure: %s", err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept failure: %s", err)
+	}
+	defer conn.Close()
+
+	// Without a redirect the original destination, when connection tracking
+	// knows it, is the listener itself.
+	dst, err := originalDst(conn)
+	if err != nil {
+		t.Skipf("original destination not available: %s", err)
+	}
+	if dst.String() != listener.Addr().String() {
+		t.Fatalf("should get %s but got %s", listener.Addr(), dst)
+	}
+}
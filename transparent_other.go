@@ -0,0 +1,12 @@
+//go:build !linux
+
+package socks5
+
+import (
+	"net"
+)
+
+// originalDst is only supported on Linux.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, ErrTransparentModeNotSupported
+}
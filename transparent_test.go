@@ -0,0 +1,41 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseOriginalDst(t *testing.T) {
+	tests := []struct {
+		Name string
+		Data []byte
+		IPv6 bool
+		Want string
+	}{
+		{"IPv4", []byte{2, 0, 0x01, 0xbb, 93, 184, 216, 34, 0, 0, 0, 0, 0, 0, 0, 0}, false, "93.184.216.34:443"},
+		{"IPv6", []byte{10, 0, 0x1f, 0x90, 0, 0, 0, 0, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0}, true, "[2001:db8::1]:8080"},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			addr, err := parseOriginalDst(test.Data, test.IPv6)
+			if err != nil {
+				t.Fatalf("should get error nil but got %s", err)
+			}
+			if addr.String() != test.Want {
+				t.Fatalf("should get %s but got %s", test.Want, addr)
+			}
+		})
+	}
+
+	if _, err := parseOriginalDst([]byte{2, 0, 0x01, 0xbb}, false); err == nil {
+		t.Fatalf("should fail to parse a truncated address")
+	}
+}
+
+func TestTransparentModeRequiresTCP(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	if err := handleConnection(&session{conn: server}, &Config{TransparentMode: true}); err == nil {
+		t.Fatalf("should fail to find the original destination of a pipe")
+	}
+}
@@ -0,0 +1,409 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxUDPPacketSize is the largest datagram the relay can receive.
+const maxUDPPacketSize = 65535
+
+// udpKeepAlive is a datagram with an empty payload for 0.0.0.0:0, see
+// Config.UDPKeepAlive.
+var udpKeepAlive = []byte{ReservedField, ReservedField, 0, TypeIPv4, 0, 0, 0, 0, 0, 0}
+
+// WriteUDPKeepAlive sends a keepalive datagram to the UDP relay at addr, or
+// from a relay to its client at addr. The relay drops it; clients should
+// too.
+func WriteUDPKeepAlive(conn net.PacketConn, addr net.Addr) error {
+	_, err := conn.WriteTo(udpKeepAlive, addr)
+	return err
+}
+
+// IsUDPKeepAlive reports whether datagram is a keepalive.
+func IsUDPKeepAlive(datagram []byte) bool {
+	return bytes.Equal(datagram, udpKeepAlive)
+}
+
+// requestUDP sets up a relay for a UDP ASSOCIATE request and replies with
+// its address.
+func requestUDP(ctx context.Context, config *Config, info ConnInfo, conn io.ReadWriter) (*udpRelay, error) {
+	// Relay over the address family the client used to reach the server
+	localIP := addrIP(info.LocalAddr)
+	network := "udp4"
+	if localIP != nil && localIP.To4() == nil {
+		network = "udp6"
+	}
+	// Bind the relay to the address the client reached the server on, so
+	// that datagrams come back from the address it sends them to. Behind NAT
+	// that address isn't the one the client knows, so keep listening on
+	// every interface when AdvertisedIP is set.
+	var bindIP net.IP
+	if config.AdvertisedIP == nil && localIP != nil && !localIP.IsUnspecified() {
+		bindIP = localIP
+	}
+	release, err := config.udpLimit.acquire()
+	if err != nil {
+		WriteRequestFailureMessage(conn, ReplyServerFailure)
+		return nil, err
+	}
+	packetConn, err := listenRelay(config, network, bindIP, addrIP(info.RemoteAddr))
+	if err != nil {
+		release()
+		log.Println(err.Error())
+		WriteRequestFailureMessage(conn, ReplyServerFailure)
+		return nil, err
+	}
+	relay := &udpRelay{
+		conn:    packetConn,
+		config:  config,
+		info:    info,
+		ctx:     ctx,
+		release: release,
+	}
+	if config.UDPStrictSource == nil || *config.UDPStrictSource {
+		relay.clientIP = addrIP(info.RemoteAddr)
+		relay.targets = make(map[string]struct{})
+	}
+
+	// Advertise the address the relay is bound to, which is the one the
+	// client reached the server on unless UDPPacketConn or UDPRelayFactory
+	// provided the relay, or that address if the relay listens on every interface,
+	// unless configured otherwise.
+	ip := addrIP(packetConn.LocalAddr())
+	if ip == nil || ip.IsUnspecified() {
+		ip = localIP
+	}
+	if config.AdvertisedIP != nil {
+		ip = config.AdvertisedIP
+	}
+	if err := writeBoundAddress(conn, config, ip, uint16(addrPort(packetConn.LocalAddr()))); err != nil {
+		relay.Close()
+		return nil, err
+	}
+	return relay, nil
+}
+
+// listenRelay listens for the datagrams of the client at clientIP on ip, or
+// on every interface if ip is nil.
+func listenRelay(config *Config, network string, ip, clientIP net.IP) (net.PacketConn, error) {
+	if config.UDPPacketConn != nil {
+		return muxedConn(config.UDPPacketConn).open(clientIP), nil
+	}
+	if config.UDPRelayFactory != nil {
+		return config.UDPRelayFactory()
+	}
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: ip})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// udpLimiter counts the UDP relays open at once for
+// Config.MaxUDPAssociations.
+type udpLimiter struct {
+	mu     sync.Mutex
+	active int
+	max    int
+}
+
+func newUDPLimiter(config *Config) *udpLimiter {
+	if config.MaxUDPAssociations <= 0 {
+		return nil
+	}
+	return &udpLimiter{max: config.MaxUDPAssociations}
+}
+
+// acquire takes a slot for a relay. The returned function gives it back.
+func (l *udpLimiter) acquire() (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active >= l.max {
+		return nil, ErrUDPAssociationLimit
+	}
+	l.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.active--
+		})
+	}, nil
+}
+
+// udpRelay relays datagrams between a client and its targets. Datagrams from
+// the client carry a SOCKS5 UDP request header naming their destination;
+// datagrams from targets are sent back to the client with such a header
+// naming their source.
+type udpRelay struct {
+	conn      net.PacketConn
+	config    *Config
+	info      ConnInfo
+	ctx       context.Context // of the control connection
+	closeOnce sync.Once
+	release   func() // gives back the slot of MaxUDPAssociations
+
+	// meter, if set, records the activity of the relay
+	meter *trafficMeter
+
+	// clientIP is the IP of the control connection. The first datagram from
+	// it determines the client address; nil accepts any source.
+	clientIP   net.IP
+	clientAddr net.Addr
+
+	// mu guards clientAddr and sent for the keepalives. sent tells whether
+	// a datagram went to the client since the last keepalive tick.
+	mu   sync.Mutex
+	sent bool
+
+	// targets holds the destinations the client sent to, the only sources
+	// accepted for replies. It is nil if replies are accepted from anywhere.
+	targets map[string]struct{}
+}
+
+// serve relays datagrams until the control connection is closed.
+func (r *udpRelay) serve(control io.Reader) error {
+	go r.relay()
+	if r.config.UDPKeepAlive > 0 {
+		defer r.startKeepAlive(r.config.UDPKeepAlive)()
+	}
+	io.Copy(io.Discard, control)
+	r.Close()
+	return nil
+}
+
+func (r *udpRelay) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		err = r.conn.Close()
+		if r.release != nil {
+			r.release()
+		}
+	})
+	return err
+}
+
+func (r *udpRelay) relay() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, from, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if r.fromClient(from) {
+			r.touch()
+			if !IsUDPKeepAlive(buf[:n]) {
+				r.sendToTarget(buf[:n])
+			}
+		} else if r.fromTarget(from) {
+			r.touch()
+			r.sendToClient(from, buf[:n])
+		}
+	}
+}
+
+func (r *udpRelay) fromClient(from net.Addr) bool {
+	if r.clientAddr != nil {
+		return from.String() == r.clientAddr.String()
+	}
+	if r.clientIP == nil || r.clientIP.Equal(addrIP(from)) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.clientAddr = from
+		return true
+	}
+	return false
+}
+
+func (r *udpRelay) fromTarget(from net.Addr) bool {
+	if r.targets == nil {
+		return true
+	}
+	_, ok := r.targets[from.String()]
+	return ok
+}
+
+// sendToTarget strips the request header of a datagram from the client and
+// sends its payload to the destination named in the header.
+func (r *udpRelay) sendToTarget(datagram []byte) {
+	// Read reserved, fragment number and address type
+	if len(datagram) < 4 || datagram[0] != ReservedField || datagram[1] != ReservedField {
+		return
+	}
+	if datagram[2] != 0 {
+		// Fragmentation is not supported, drop fragments
+		return
+	}
+	reader := bytes.NewReader(datagram[4:])
+	host, port, err := readAddress(reader, datagram[3])
+	if err != nil || (datagram[3] == TypeDomain && !validDomain(host)) {
+		return
+	}
+	data := datagram[len(datagram)-reader.Len():]
+
+	req := &Request{
+		ClientRequestMessage: ClientRequestMessage{Cmd: CmdUDP, AddrType: datagram[3], Address: host, Port: port},
+		ConnInfo:             r.info,
+		ctx:                  r.ctx,
+	}
+	if datagram[3] == TypeDomain {
+		ips, err := lookupIPs(r.ctx, host, r.config)
+		if err != nil {
+			log.Printf("udp relay resolve %s failure: %s", host, err)
+			return
+		}
+		req.IPs = ips
+	} else {
+		req.IPs = []net.IP{net.ParseIP(host)}
+	}
+	ip := req.IPs[0]
+	zone, err := targetZone(ip, r.config)
+	if err != nil {
+		log.Printf("udp relay send to %s failure: %s", ip, err)
+		return
+	}
+	addr := &net.UDPAddr{IP: ip, Port: int(port), Zone: zone}
+	if err := r.checkDestination(req, addr); err != nil {
+		log.Printf("udp relay drop datagram to %s: %s", addr, err)
+		if r.config.OnUDPDestinationDenied != nil {
+			r.config.OnUDPDestinationDenied(r.info, addr, err)
+		}
+		return
+	}
+	if r.targets != nil {
+		r.targets[addr.String()] = struct{}{}
+	}
+	if _, err := r.conn.WriteTo(data, addr); err != nil {
+		log.Printf("udp relay send failure: %s", err)
+	}
+}
+
+// checkDestination refuses destinations that would loop datagrams through
+// the relay or fan them out, then runs the checks of CONNECT requests on
+// req, the request of the datagram to addr.
+func (r *udpRelay) checkDestination(req *Request, addr *net.UDPAddr) error {
+	if addr.IP.IsMulticast() || isBroadcastIP(addr.IP) {
+		return ErrUDPBroadcast
+	}
+	local := r.conn.LocalAddr()
+	if addr.Port == addrPort(local) {
+		localIP := addrIP(local)
+		if localIP.Equal(addr.IP) || (localIP == nil || localIP.IsUnspecified()) && isLocalIP(addr.IP) {
+			return ErrUDPRelayLoop
+		}
+	}
+	if !allowPort(r.config, req.Port) {
+		return ErrPortNotAllowed
+	}
+	if err := checkSelfConnect(r.config, req); err != nil {
+		return err
+	}
+	return allowDestination(r.config, req)
+}
+
+// isBroadcastIP reports whether ip is the limited broadcast address or the
+// broadcast address of a network of this host.
+func isBroadcastIP(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	if ip4.Equal(net.IPv4bcast) {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		mask := ipNet.Mask
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
+		if ones, _ := mask.Size(); ones >= 31 {
+			// Point-to-point networks have no broadcast address
+			continue
+		}
+		broadcast := make(net.IP, net.IPv4len)
+		for i, b := range ipNet.IP.To4() {
+			broadcast[i] = b | ^mask[i]
+		}
+		if ip4.Equal(broadcast) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendToClient prepends a request header naming from to a datagram from a
+// target and sends it to the client.
+func (r *udpRelay) sendToClient(from net.Addr, data []byte) {
+	if r.clientAddr == nil {
+		return
+	}
+	ip := addrIP(from)
+	addrType := TypeIPv4
+	if ip.To4() == nil {
+		addrType = TypeIPv6
+	}
+	header, err := appendAddress([]byte{ReservedField, ReservedField, 0, addrType}, addrType, ip.String(), uint16(addrPort(from)))
+	if err != nil {
+		return
+	}
+	if _, err := r.conn.WriteTo(append(header, data...), r.clientAddr); err != nil {
+		log.Printf("udp relay reply failure: %s", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = true
+}
+
+func (r *udpRelay) touch() {
+	if r.meter != nil {
+		r.meter.touch()
+	}
+}
+
+// startKeepAlive starts sending keepalives to the client whenever the relay
+// sent it nothing for interval. The returned function stops it.
+func (r *udpRelay) startKeepAlive(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				r.mu.Lock()
+				addr, idle := r.clientAddr, !r.sent
+				r.sent = false
+				r.mu.Unlock()
+				if addr != nil && idle {
+					if err := WriteUDPKeepAlive(r.conn, addr); err != nil {
+						log.Printf("udp relay keepalive failure: %s", err)
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
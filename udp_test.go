@@ -0,0 +1,560 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type packet struct {
+	data []byte
+	addr net.Addr
+}
+
+// fakePacketConn is an in-memory net.PacketConn: datagrams pushed to in are
+// received by the relay, datagrams sent by the relay show up on out.
+type fakePacketConn struct {
+	in     chan packet
+	out    chan packet
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakePacketConn() *fakePacketConn {
+	return &fakePacketConn{
+		in:     make(chan packet, 16),
+		out:    make(chan packet, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *fakePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.in:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *fakePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.out <- packet{data: append([]byte{}, p...), addr: addr}
+	return len(p), nil
+}
+
+func (c *fakePacketConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakePacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+}
+
+func (c *fakePacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fakePacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakePacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// udpDatagram builds a datagram with a SOCKS5 UDP request header for addr.
+func udpDatagram(t *testing.T, addr *net.UDPAddr, data []byte) []byte {
+	t.Helper()
+	addrType := TypeIPv4
+	if addr.IP.To4() == nil {
+		addrType = TypeIPv6
+	}
+	buf, err := appendAddress([]byte{ReservedField, ReservedField, 0, addrType}, addrType, addr.IP.String(), uint16(addr.Port))
+	if err != nil {
+		t.Fatalf("build datagram failure: %s", err)
+	}
+	return append(buf, data...)
+}
+
+// udpAssociate performs a no-auth handshake and a UDP ASSOCIATE through the
+// proxy at proxyAddr and returns the control connection and the relay reply.
+func udpAssociate(t *testing.T, proxyAddr string) (net.Conn, *ServerReplyMessage) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy failure: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+	WriteClientRequestMessage(conn, &ClientRequestMessage{Cmd: CmdUDP, AddrType: TypeIPv4, Address: "0.0.0.0"})
+	if _, err := ReadServerAuthMessage(conn); err != nil {
+		t.Fatalf("read auth reply failure: %s", err)
+	}
+	reply, err := ReadServerReplyMessage(conn)
+	if err != nil {
+		t.Fatalf("read request reply failure: %s", err)
+	}
+	return conn, reply
+}
+
+func TestUDPRelayFactory(t *testing.T) {
+	packetConn := newFakePacketConn()
+	config := Config{
+		AuthMethod:      MethodNoAuth,
+		UDPRelayFactory: func() (net.PacketConn, error) { return packetConn, nil },
+	}
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- handleConnection(&session{conn: server}, &config) }()
+
+	WriteClientAuthMessage(client, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+	ReadServerAuthMessage(client)
+	WriteClientRequestMessage(client, &ClientRequestMessage{Cmd: CmdUDP, AddrType: TypeIPv4, Address: "0.0.0.0"})
+	reply, err := ReadServerReplyMessage(client)
+	if err != nil {
+		t.Fatalf("should get error nil but got %s", err)
+	}
+	if reply.Reply != ReplySuccess || reply.Port != 5000 {
+		t.Fatalf("should get relay port 5000 but got %v", reply)
+	}
+
+	clientAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 4000}
+	targetAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 53}
+	packetConn.in <- packet{data: udpDatagram(t, targetAddr, []byte("query")), addr: clientAddr}
+	if pkt := <-packetConn.out; string(pkt.data) != "query" || pkt.addr.String() != targetAddr.String() {
+		t.Fatalf("should send %q to %s but sent %q to %s", "query", targetAddr, pkt.data, pkt.addr)
+	}
+
+	packetConn.in <- packet{data: []byte("answer"), addr: targetAddr}
+	want := udpDatagram(t, targetAddr, []byte("answer"))
+	if pkt := <-packetConn.out; !bytes.Equal(pkt.data, want) || pkt.addr.String() != clientAddr.String() {
+		t.Fatalf("should send %v to %s but sent %v to %s", want, clientAddr, pkt.data, pkt.addr)
+	}
+
+	client.Close()
+	<-done
+	select {
+	case <-packetConn.closed:
+	default:
+		t.Fatalf("should close the relay with the control connection")
+	}
+}
+
+func TestUDPStrictSource(t *testing.T) {
+	clientAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 4000}
+	targetAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 53}
+	strangerAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 66), Port: 53}
+	strict, loose := true, false
+	tests := []struct {
+		Name            string
+		UDPStrictSource *bool
+		Forwarded       bool
+	}{
+		{"default", nil, false},
+		{"strict", &strict, false},
+		{"loose", &loose, true},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			packetConn := newFakePacketConn()
+			config := Config{
+				UDPRelayFactory: func() (net.PacketConn, error) { return packetConn, nil },
+				UDPStrictSource: test.UDPStrictSource,
+			}
+			info := ConnInfo{
+				RemoteAddr: &net.TCPAddr{IP: clientAddr.IP, Port: 50000},
+				LocalAddr:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080},
+			}
+			relay, err := requestUDP(context.Background(), &config, info, &bytes.Buffer{})
+			if err != nil {
+				t.Fatalf("should get error nil but got %s", err)
+			}
+			defer relay.Close()
+			go relay.relay()
+
+			packetConn.in <- packet{data: udpDatagram(t, targetAddr, []byte("query")), addr: clientAddr}
+			<-packetConn.out
+
+			// Datagrams are handled in order, so the first one sent to the
+			// client tells whether the stranger's got through.
+			packetConn.in <- packet{data: []byte("spoofed"), addr: strangerAddr}
+			packetConn.in <- packet{data: []byte("answer"), addr: targetAddr}
+			pkt := <-packetConn.out
+			forwarded := bytes.HasSuffix(pkt.data, []byte("spoofed"))
+			if forwarded != test.Forwarded {
+				t.Fatalf("should forward datagram from %s: %v but got %v", strangerAddr, test.Forwarded, forwarded)
+			}
+			if pkt.addr.String() != clientAddr.String() {
+				t.Fatalf("should send to %s but sent to %s", clientAddr, pkt.addr)
+			}
+		})
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	_, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth})
+	_, reply := udpAssociate(t, proxyAddr)
+	relayAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(reply.Address, strconv.Itoa(int(reply.Port))))
+	if err != nil {
+		t.Fatalf("resolve relay failure: %s", err)
+	}
+
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("dial relay failure: %s", err)
+	}
+	defer client.Close()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	if _, err := client.Write(udpDatagram(t, echoAddr, []byte("ping"))); err != nil {
+		t.Fatalf("write failure: %s", err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, maxUDPPacketSize)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("read failure: %s", err)
+	}
+	if want := udpDatagram(t, echoAddr, []byte("ping")); !bytes.Equal(buf[:n], want) {
+		t.Fatalf("should receive %v but got %v", want, buf[:n])
+	}
+}
+
+func TestUDPAllowDestination(t *testing.T) {
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen failure: %s", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	allowed, denied := listen(), listen()
+	deniedAddr := denied.LocalAddr().(*net.UDPAddr)
+
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod: MethodNoAuth,
+		AllowDestination: func(req *Request) error {
+			if req.Cmd == CmdUDP && int(req.Port) == deniedAddr.Port {
+				return &RejectError{Reply: ReplyConnectionNotAllowed}
+			}
+			return nil
+		},
+	})
+	_, reply := udpAssociate(t, proxyAddr)
+	if reply.Reply != ReplySuccess {
+		t.Fatalf("should get reply success but got %d", reply.Reply)
+	}
+	relayAddr := &net.UDPAddr{IP: net.ParseIP(reply.Address), Port: int(reply.Port)}
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("dial relay failure: %s", err)
+	}
+	defer client.Close()
+
+	// The relay handles datagrams in order, so once the allowed one
+	// arrives the denied one has been dropped
+	client.Write(udpDatagram(t, deniedAddr, []byte("denied")))
+	client.Write(udpDatagram(t, allowed.LocalAddr().(*net.UDPAddr), []byte("allowed")))
+	buf := make([]byte, maxUDPPacketSize)
+	allowed.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, _, err := allowed.ReadFrom(buf); err != nil || string(buf[:n]) != "allowed" {
+		t.Fatalf("should receive allowed but got %q, %v", buf[:n], err)
+	}
+	denied.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := denied.ReadFrom(buf); err == nil {
+		t.Fatalf("should drop the datagram to a denied destination but got %q", buf[:n])
+	}
+}
+
+func TestUDPRelayFamily(t *testing.T) {
+	tests := []struct {
+		Name     string
+		LocalIP  net.IP
+		Network  string
+		AddrType AddressType
+	}{
+		{"IPv4 control connection", net.IPv4(127, 0, 0, 1), "udp4", TypeIPv4},
+		{"IPv6 control connection", net.IPv6loopback, "udp6", TypeIPv6},
+		// Any 127/8 address reaches the host, as on one with several
+		// interfaces
+		{"Second IPv4 address", net.IPv4(127, 0, 0, 2), "udp4", TypeIPv4},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			info := ConnInfo{LocalAddr: &net.TCPAddr{IP: test.LocalIP, Port: 1080}}
+			var buf bytes.Buffer
+			relay, err := requestUDP(context.Background(), &Config{}, info, &buf)
+			if err != nil {
+				t.Skipf("%s relay not available: %s", test.Network, err)
+			}
+			defer relay.Close()
+
+			if ip := addrIP(relay.conn.LocalAddr()); !ip.Equal(test.LocalIP) {
+				t.Fatalf("should bind a %s relay to %s but got %s", test.Network, test.LocalIP, relay.conn.LocalAddr())
+			}
+			reply, err := ReadServerReplyMessage(&buf)
+			if err != nil {
+				t.Fatalf("should get error nil but got %s", err)
+			}
+			if reply.AddrType != test.AddrType || !net.ParseIP(reply.Address).Equal(test.LocalIP) {
+				t.Fatalf("should advertise %s but got %v", test.LocalIP, reply)
+			}
+		})
+	}
+
+	t.Run("advertised IP", func(t *testing.T) {
+		info := ConnInfo{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}}
+		config := Config{AdvertisedIP: net.IPv4(203, 0, 113, 7)}
+		var buf bytes.Buffer
+		relay, err := requestUDP(context.Background(), &config, info, &buf)
+		if err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+		defer relay.Close()
+		if ip := addrIP(relay.conn.LocalAddr()); !ip.IsUnspecified() {
+			t.Fatalf("should listen on every interface but got %s", relay.conn.LocalAddr())
+		}
+		reply, err := ReadServerReplyMessage(&buf)
+		if err != nil {
+			t.Fatalf("should get error nil but got %s", err)
+		}
+		if reply.Address != "203.0.113.7" {
+			t.Fatalf("should advertise 203.0.113.7 but got %s", reply.Address)
+		}
+	})
+}
+
+func TestUDPDestinationDenied(t *testing.T) {
+	packetConn := newFakePacketConn()
+	denied := make(chan error, 4)
+	config := Config{
+		AuthMethod:      MethodNoAuth,
+		UDPRelayFactory: func() (net.PacketConn, error) { return packetConn, nil },
+		OnUDPDestinationDenied: func(info ConnInfo, dst net.Addr, err error) {
+			denied <- err
+		},
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleConnection(&session{conn: server}, &config)
+
+	WriteClientAuthMessage(client, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+	ReadServerAuthMessage(client)
+	WriteClientRequestMessage(client, &ClientRequestMessage{Cmd: CmdUDP, AddrType: TypeIPv4, Address: "0.0.0.0"})
+	if _, err := ReadServerReplyMessage(client); err != nil {
+		t.Fatalf("read reply failure: %s", err)
+	}
+
+	clientAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 4000}
+	tests := []struct {
+		Name string
+		Addr *net.UDPAddr
+		Err  error
+	}{
+		{"relay itself", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}, ErrUDPRelayLoop},
+		{"broadcast", &net.UDPAddr{IP: net.IPv4bcast, Port: 53}, ErrUDPBroadcast},
+		{"multicast", &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}, ErrUDPBroadcast},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			packetConn.in <- packet{data: udpDatagram(t, test.Addr, []byte("query")), addr: clientAddr}
+			if err := <-denied; err != test.Err {
+				t.Fatalf("should get error %s but got %v", test.Err, err)
+			}
+		})
+	}
+
+	// Datagrams to other destinations still go through, and only they do
+	targetAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 53}
+	packetConn.in <- packet{data: udpDatagram(t, targetAddr, []byte("query")), addr: clientAddr}
+	if pkt := <-packetConn.out; pkt.addr.String() != targetAddr.String() {
+		t.Fatalf("should only send to %s but sent to %s", targetAddr, pkt.addr)
+	}
+}
+
+func TestUDPKeepAlive(t *testing.T) {
+	_, proxyAddr := startServer(t, &Config{
+		AuthMethod:        MethodNoAuth,
+		IdleTimeout:       300 * time.Millisecond,
+		IdleSweepInterval: 20 * time.Millisecond,
+		UDPKeepAlive:      50 * time.Millisecond,
+	})
+	control, reply := udpAssociate(t, proxyAddr)
+	relayAddr := &net.UDPAddr{IP: net.ParseIP(reply.Address), Port: int(reply.Port)}
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp failure: %s", err)
+	}
+	defer client.Close()
+
+	received := make(chan struct{}, 64)
+	go func() {
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, _, err := client.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if IsUDPKeepAlive(buf[:n]) {
+				received <- struct{}{}
+			}
+		}
+	}()
+
+	// Keepalives from the client keep the association open past IdleTimeout
+	for i := 0; i < 12; i++ {
+		if err := WriteUDPKeepAlive(client, relayAddr); err != nil {
+			t.Fatalf("write keepalive failure: %s", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	control.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := control.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("should keep the association open but got %v", err)
+	}
+	select {
+	case <-received:
+	default:
+		t.Fatalf("should get keepalives from the relay")
+	}
+
+	// Without them the association is idle
+	control.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := control.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("should close the idle association but got %v", err)
+	}
+}
+
+func TestUDPPreboundRelay(t *testing.T) {
+	// A socket bound beforehand, on another address than the one the
+	// client reaches the server on
+	prebound, err := net.ListenPacket("udp4", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("listen on 127.0.0.2 failure: %s", err)
+	}
+	defer prebound.Close()
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	server, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth, UDPPacketConn: prebound})
+	relayAddr := prebound.LocalAddr().(*net.UDPAddr)
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	associate := func(t *testing.T) (net.Conn, *net.UDPConn) {
+		t.Helper()
+		control, reply := udpAssociate(t, proxyAddr)
+		if reply.Address != "127.0.0.2" || int(reply.Port) != relayAddr.Port {
+			t.Fatalf("should advertise %s but got %s:%d", relayAddr, reply.Address, reply.Port)
+		}
+		client, err := net.DialUDP("udp4", nil, relayAddr)
+		if err != nil {
+			t.Fatalf("dial relay failure: %s", err)
+		}
+		t.Cleanup(func() { client.Close() })
+		return control, client
+	}
+	exchange := func(t *testing.T, client *net.UDPConn, payload string) {
+		t.Helper()
+		want := udpDatagram(t, echoAddr, []byte(payload))
+		client.Write(want)
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, maxUDPPacketSize)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("read failure: %s", err)
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Fatalf("should receive %v but got %v", want, buf[:n])
+		}
+	}
+	waitClosed := func(t *testing.T) {
+		t.Helper()
+		for end := time.Now().Add(2 * time.Second); server.ConnectionCount() != 0 && time.Now().Before(end); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := server.ConnectionCount(); n != 0 {
+			t.Fatalf("should count no connection but got %d", n)
+		}
+	}
+
+	t.Run("in sequence", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			control, client := associate(t)
+			exchange(t, client, "ping")
+			// The association ending leaves the shared socket open
+			control.Close()
+			waitClosed(t)
+		}
+	})
+
+	t.Run("at once", func(t *testing.T) {
+		firstControl, first := associate(t)
+		secondControl, second := associate(t)
+		exchange(t, first, "first")
+		exchange(t, second, "second")
+		exchange(t, first, "first again")
+		firstControl.Close()
+		exchange(t, second, "second again")
+		secondControl.Close()
+		waitClosed(t)
+	})
+}
+
+func TestMaxUDPAssociations(t *testing.T) {
+	_, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth, MaxUDPAssociations: 2})
+
+	first, reply := udpAssociate(t, proxyAddr)
+	if reply.Reply != ReplySuccess {
+		t.Fatalf("should get reply %d but got %d", ReplySuccess, reply.Reply)
+	}
+	if _, reply := udpAssociate(t, proxyAddr); reply.Reply != ReplySuccess {
+		t.Fatalf("should get reply %d but got %d", ReplySuccess, reply.Reply)
+	}
+	if _, reply := udpAssociate(t, proxyAddr); reply.Reply != ReplyServerFailure {
+		t.Fatalf("should get reply %d over the limit but got %d", ReplyServerFailure, reply.Reply)
+	}
+
+	// Closing an association frees its slot
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, reply := udpAssociate(t, proxyAddr)
+		if reply.Reply == ReplySuccess {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("should get reply %d after an association closed but got %d", ReplySuccess, reply.Reply)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,159 @@
+package socks5
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// udpMuxes holds the mux of every Config.UDPPacketConn in use, so that the
+// configurations sharing one, e.g. across UpdateConfig, share its routes.
+var udpMuxes sync.Map // net.PacketConn to *udpMux
+
+// udpMux routes the datagrams of a Config.UDPPacketConn to the associations
+// sharing it. A datagram goes to the association that last sent to its
+// source, whether that is the client or a target, and otherwise to the
+// oldest association of the same client IP that has not received any yet.
+type udpMux struct {
+	conn net.PacketConn
+
+	mu     sync.Mutex
+	conns  []*muxConn          // in the order the associations started
+	routes map[string]*muxConn // by source address
+}
+
+// muxedConn returns the mux of conn, starting it on first use.
+func muxedConn(conn net.PacketConn) *udpMux {
+	if m, ok := udpMuxes.Load(conn); ok {
+		return m.(*udpMux)
+	}
+	m, loaded := udpMuxes.LoadOrStore(conn, &udpMux{conn: conn, routes: make(map[string]*muxConn)})
+	if !loaded {
+		go m.(*udpMux).serve()
+	}
+	return m.(*udpMux)
+}
+
+// open returns the packet connection of an association of the client at
+// ip, or of any client if ip is nil.
+func (m *udpMux) open(ip net.IP) *muxConn {
+	c := &muxConn{
+		mux:      m,
+		clientIP: ip,
+		in:       make(chan muxPacket, 64),
+		done:     make(chan struct{}),
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conns = append(m.conns, c)
+	return c
+}
+
+// serve reads datagrams until the shared connection fails, e.g. once its
+// owner closes it.
+func (m *udpMux) serve() {
+	defer udpMuxes.Delete(m.conn)
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, from, err := m.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		c := m.route(from)
+		if c == nil {
+			continue
+		}
+		select {
+		case c.in <- muxPacket{data: append([]byte(nil), buf[:n]...), addr: from}:
+		default:
+			// Drop the datagram as a full socket buffer would
+		}
+	}
+}
+
+func (m *udpMux) route(from net.Addr) *muxConn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.routes[from.String()]; ok {
+		return c
+	}
+	for _, c := range m.conns {
+		if !c.claimed && (c.clientIP == nil || c.clientIP.Equal(addrIP(from))) {
+			c.claimed = true
+			m.routes[from.String()] = c
+			return c
+		}
+	}
+	return nil
+}
+
+// removeLocked forgets c and its routes. m.mu must be held.
+func (m *udpMux) removeLocked(c *muxConn) {
+	for i, other := range m.conns {
+		if other == c {
+			m.conns = append(m.conns[:i], m.conns[i+1:]...)
+			break
+		}
+	}
+	for addr, other := range m.routes {
+		if other == c {
+			delete(m.routes, addr)
+		}
+	}
+}
+
+type muxPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// muxConn is the packet connection of an association on a shared
+// Config.UDPPacketConn. Closing it leaves the shared connection open.
+// Deadlines are not supported, the relay doesn't use them.
+type muxConn struct {
+	mux      *udpMux
+	clientIP net.IP
+	claimed  bool // guarded by mux.mu
+	in       chan muxPacket
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (c *muxConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.in:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *muxConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mux.mu.Lock()
+	select {
+	case <-c.done:
+		c.mux.mu.Unlock()
+		return 0, net.ErrClosed
+	default:
+	}
+	c.mux.routes[addr.String()] = c
+	c.mux.mu.Unlock()
+	return c.mux.conn.WriteTo(p, addr)
+}
+
+func (c *muxConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mux.mu.Lock()
+		defer c.mux.mu.Unlock()
+		close(c.done)
+		c.mux.removeLocked(c)
+	})
+	return nil
+}
+
+func (c *muxConn) LocalAddr() net.Addr { return c.mux.conn.LocalAddr() }
+
+func (c *muxConn) SetDeadline(t time.Time) error      { return nil }
+func (c *muxConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *muxConn) SetWriteDeadline(t time.Time) error { return nil }
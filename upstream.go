@@ -0,0 +1,210 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var ErrUpstreamProxyNotSupported = errors.New("upstream proxy scheme not supported")
+
+// parseUpstreamProxy parses config.UpstreamProxy, which must be an http or
+// https URL.
+func parseUpstreamProxy(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, ErrUpstreamProxyNotSupported
+	}
+	return u, nil
+}
+
+// Health of the upstream proxies: one that failed upstreamMaxFailures times
+// in a row is skipped for upstreamCooldown.
+const (
+	upstreamMaxFailures = 3
+	upstreamCooldown    = 30 * time.Second
+)
+
+// upstreams are the upstream proxies of config.UpstreamProxy and
+// config.UpstreamProxies in order, nil for none.
+type upstreams []*upstreamProxy
+
+type upstreamProxy struct {
+	url *url.URL
+
+	mu        sync.Mutex
+	failures  int // consecutive
+	downUntil time.Time
+}
+
+func newUpstreams(config *Config) (upstreams, error) {
+	var rawURLs []string
+	if config.UpstreamProxy != "" {
+		rawURLs = append(rawURLs, config.UpstreamProxy)
+	}
+	rawURLs = append(rawURLs, config.UpstreamProxies...)
+	var u upstreams
+	for _, rawURL := range rawURLs {
+		proxyURL, err := parseUpstreamProxy(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		u = append(u, &upstreamProxy{url: proxyURL})
+	}
+	return u, nil
+}
+
+// healthy reports whether p isn't being skipped after repeated failures.
+func (p *upstreamProxy) healthy() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Now().After(p.downUntil)
+}
+
+// done records the outcome of a dial through p.
+func (p *upstreamProxy) done(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		p.failures = 0
+		return
+	}
+	if p.failures++; p.failures >= upstreamMaxFailures {
+		p.failures = 0
+		p.downUntil = time.Now().Add(upstreamCooldown)
+	}
+}
+
+// dialer returns a dial function connecting to targets through the first
+// reachable upstream proxy, skipping those that keep failing unless all of
+// them do. A proxy refusing the target counts as reachable, and its reply is
+// final.
+func (u upstreams) dialer(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	dialers := make([]func(ctx context.Context, network, address string) (net.Conn, error), len(u))
+	for i, p := range u {
+		dialers[i] = upstreamDialer(p.url, dial)
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		var candidates []int
+		for i, p := range u {
+			if p.healthy() {
+				candidates = append(candidates, i)
+			}
+		}
+		if len(candidates) == 0 {
+			for i := range u {
+				candidates = append(candidates, i)
+			}
+		}
+
+		var lastErr error
+		for _, i := range candidates {
+			conn, err := dialers[i](ctx, network, address)
+			var rejectErr *RejectError
+			if err == nil || errors.As(err, &rejectErr) {
+				u[i].done(nil)
+				return conn, err
+			}
+			u[i].done(err)
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, &RejectError{
+			Reply:  ReplyNetworkUnreachable,
+			Reason: fmt.Sprintf("no upstream proxy reachable for %s: %s", address, lastErr),
+		}
+	}
+}
+
+// upstreamDialer returns a dial function connecting to targets through the
+// HTTP proxy at proxyURL with the CONNECT method. dial connects to the proxy
+// itself.
+func upstreamDialer(proxyURL *url.URL, dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL.Scheme == "https" {
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		}
+
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: address},
+			Host:   address,
+			Header: make(http.Header),
+		}
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			req.SetBasicAuth(proxyURL.User.Username(), password)
+			req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+			delete(req.Header, "Authorization")
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		// The reader may hold bytes sent by the target after the response,
+		// so reads of the tunnel go through it.
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, req)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, &RejectError{
+				Reply:  upstreamReply(resp.StatusCode),
+				Reason: fmt.Sprintf("upstream proxy CONNECT %s: %s", address, resp.Status),
+			}
+		}
+		return &peekConn{Conn: conn, r: r}, nil
+	}
+}
+
+// upstreamReply maps the status of a failed CONNECT to a reply code.
+func upstreamReply(status int) ReplyType {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusProxyAuthRequired:
+		return ReplyConnectionNotAllowed
+	case http.StatusNotFound, http.StatusBadGateway:
+		return ReplyHostUnreachable
+	case http.StatusServiceUnavailable:
+		return ReplyConnectionRefused
+	case http.StatusGatewayTimeout:
+		return ReplyTTLExpired
+	default:
+		return ReplyServerFailure
+	}
+}
@@ -0,0 +1,182 @@
+package socks5
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// startConnectProxy starts a stub HTTP proxy supporting CONNECT with Basic
+// auth as user:password.
+func startConnectProxy(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				req, err := http.ReadRequest(r)
+				if err != nil {
+					return
+				}
+				if req.Method != http.MethodConnect {
+					io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+					return
+				}
+				if req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNzd29yZA==" {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+				go io.Copy(target, r)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	proxy := startConnectProxy(t)
+	target := startEchoServer(t)
+
+	t.Run("tunnel", func(t *testing.T) {
+		_, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth, UpstreamProxy: "http://user:password@" + proxy})
+		conn := dialConnect(t, proxyAddr, target)
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("write failure: %s", err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("should get echo ping but got %q, %v", buf, err)
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		_, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth, UpstreamProxy: "http://user:wrong@" + proxy})
+		if _, reply := connectRequest(t, proxyAddr, target); reply.Reply != ReplyConnectionNotAllowed {
+			t.Fatalf("should get reply %d but got %d", ReplyConnectionNotAllowed, reply.Reply)
+		}
+	})
+
+	t.Run("unresolvable locally", func(t *testing.T) {
+		// Only the upstream proxy can resolve the name, as for hosts on its
+		// internal network
+		_, proxyAddr := startServer(t, &Config{
+			AuthMethod:    MethodNoAuth,
+			UpstreamProxy: "http://user:password@" + proxy,
+			Resolver:      staticResolver{},
+		})
+		_, port, _ := net.SplitHostPort(target)
+		portNum, _ := strconv.Atoi(port)
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("dial proxy failure: %s", err)
+		}
+		defer conn.Close()
+		WriteClientAuthMessage(conn, &ClientAuthMessage{Methods: []Method{MethodNoAuth}})
+		ReadServerAuthMessage(conn)
+		WriteClientRequestMessage(conn, &ClientRequestMessage{Cmd: CmdConnect, AddrType: TypeDomain, Address: "localhost", Port: uint16(portNum)})
+		if reply, err := ReadServerReplyMessage(conn); err != nil || reply.Reply != ReplySuccess {
+			t.Fatalf("should get reply success but got %v, %v", reply, err)
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("write failure: %s", err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("should get echo ping but got %q, %v", buf, err)
+		}
+	})
+
+	// A closed listener leaves an address refusing connections
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failure: %s", err)
+	}
+	deadProxy := "http://" + dead.Addr().String()
+	dead.Close()
+
+	t.Run("fallback", func(t *testing.T) {
+		_, proxyAddr := startServer(t, &Config{
+			AuthMethod:      MethodNoAuth,
+			UpstreamProxy:   deadProxy,
+			UpstreamProxies: []string{"http://user:password@" + proxy},
+		})
+		conn := dialConnect(t, proxyAddr, target)
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("write failure: %s", err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("should get echo ping through the secondary but got %q, %v", buf, err)
+		}
+	})
+
+	t.Run("all unreachable", func(t *testing.T) {
+		_, proxyAddr := startServer(t, &Config{AuthMethod: MethodNoAuth, UpstreamProxies: []string{deadProxy, deadProxy}})
+		if _, reply := connectRequest(t, proxyAddr, target); reply.Reply != ReplyNetworkUnreachable {
+			t.Fatalf("should get reply %d but got %d", ReplyNetworkUnreachable, reply.Reply)
+		}
+	})
+
+	t.Run("unsupported scheme", func(t *testing.T) {
+		if err := initConfig(&Config{UpstreamProxy: "ftp://" + proxy}); err != ErrUpstreamProxyNotSupported {
+			t.Fatalf("should get error %s but got %v", ErrUpstreamProxyNotSupported, err)
+		}
+	})
+}
+
+func TestUpstreamReply(t *testing.T) {
+	tests := []struct {
+		Status int
+		Reply  ReplyType
+	}{
+		{http.StatusForbidden, ReplyConnectionNotAllowed},
+		{http.StatusProxyAuthRequired, ReplyConnectionNotAllowed},
+		{http.StatusBadGateway, ReplyHostUnreachable},
+		{http.StatusServiceUnavailable, ReplyConnectionRefused},
+		{http.StatusGatewayTimeout, ReplyTTLExpired},
+		{http.StatusInternalServerError, ReplyServerFailure},
+	}
+	for _, test := range tests {
+		if reply := upstreamReply(test.Status); reply != test.Reply {
+			t.Fatalf("status %d: should get reply %d but got %d", test.Status, test.Reply, reply)
+		}
+	}
+}
+
+func TestUpstreamHealth(t *testing.T) {
+	p := &upstreamProxy{}
+	for i := 0; i < upstreamMaxFailures-1; i++ {
+		p.done(io.EOF)
+	}
+	if !p.healthy() {
+		t.Fatalf("should be healthy after %d failures", upstreamMaxFailures-1)
+	}
+	p.done(nil)
+	for i := 0; i < upstreamMaxFailures; i++ {
+		p.done(io.EOF)
+	}
+	if p.healthy() {
+		t.Fatalf("should be skipped after %d consecutive failures", upstreamMaxFailures)
+	}
+}